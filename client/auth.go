@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+)
+
+//userInfo account of the local socks5 and http proxy
+type userInfo struct {
+	Username string
+	Password string
+}
+
+//credentials accounts allowed to use the local proxy, no account means no authentication
+type credentials struct {
+	users map[string]string
+}
+
+func newCredentials(users []userInfo) *credentials {
+	c := &credentials{users: make(map[string]string, len(users))}
+	for _, v := range users {
+		c.users[v.Username] = v.Password
+	}
+	return c
+}
+
+func (c *credentials) required() bool {
+	return len(c.users) > 0
+}
+
+func (c *credentials) check(username, password string) bool {
+	expected, ok := c.users[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+//checkBasic check the value of a Proxy-Authorization header
+func (c *credentials) checkBasic(authorization string) bool {
+	const prefix = "Basic "
+	if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(authorization[len(prefix):])
+	if err != nil {
+		return false
+	}
+	index := strings.IndexByte(string(decoded), ':')
+	if index == -1 {
+		return false
+	}
+	return c.check(string(decoded[:index]), string(decoded[index+1:]))
+}
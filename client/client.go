@@ -2,29 +2,58 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/ptrbug/invis/client/crash"
 	"github.com/ptrbug/invis/crypto"
+	"github.com/ptrbug/invis/proto"
+	faketls "github.com/ptrbug/invis/tls"
 )
 
-type appConfig struct {
-	AutoStart     bool
-	ListenAddr    string
+type serverInfo struct {
+	Name          string
 	ServerAddr    string
 	Channel       string
 	Client        string
 	FakeWebDomain string
+	LegacyHello   bool
+	KeyType       string
+}
+
+type appConfig struct {
+	AutoStart         bool
+	ListenAddr        string
+	ServerAddr        string
+	Channel           string
+	Client            string
+	FakeWebDomain     string
+	LegacyHello       bool
+	KeyType           string
+	CertCacheDir      string
+	Servers           []serverInfo
+	SelectPolicy      selectPolicy
+	ProbeInterval     int
+	PingInterval      int
+	MaxMissedPongs    int
+	Shaping           *proto.ShapingPolicy
+	Users             []userInfo
+	Routing           routingConfig
+	MetricsListenAddr string
+	Control           controlConfig
 }
 
 var loger *log.Logger
 var config appConfig
-var pool *sessionPool
+var servers *serverGroup
+var auth *credentials
+var routing *router
 
 func init() {
 	err := crash.InitPanicFile("panic.log")
@@ -47,7 +76,7 @@ func main() {
 	if nil != err {
 		panic(err)
 	}
-	loger := log.New(logFile, "", log.Ldate|log.Ltime|log.Lshortfile)
+	loger = log.New(logFile, "", log.Ldate|log.Ltime|log.Lshortfile)
 
 	data, err := ioutil.ReadFile("config.json")
 	if err != nil {
@@ -58,25 +87,34 @@ func main() {
 		loger.Fatal("Unmarshal config.json file error", err)
 	}
 
-	channelUUID, err := uuid.Parse(config.Channel)
-	if err != nil {
-		loger.Fatal("parse channel uuid error", err)
-	}
+	setAutoStart(config.AutoStart)
 
-	clientUUID, err := uuid.Parse(config.Client)
+	auth = newCredentials(config.Users)
+
+	routing, err = newRouter(config.Routing)
 	if err != nil {
-		loger.Fatal("parse client uuid error", err)
+		loger.Fatal("routing config error", err)
 	}
 
-	cert, err := crypto.CreateX509KeyPair(clientUUID[:], 2048)
+	servers, err = newServers(&config)
 	if err != nil {
-		loger.Fatal("createX509KeyPair error", err)
+		loger.Fatal("servers config error", err)
 	}
+	servers.run()
 
-	setAutoStart(config.AutoStart)
+	if config.MetricsListenAddr != "" {
+		err = runMetricsServ(config.MetricsListenAddr)
+		if err != nil {
+			loger.Fatal("metrics server error", err)
+		}
+	}
 
-	pool = pool.newSessionPool(config.ServerAddr, config.FakeWebDomain, cert, channelUUID[:], clientUUID[:])
-	pool.run()
+	if config.Control.ListenAddr != "" {
+		err = runControlServ(config.Control)
+		if err != nil {
+			loger.Fatal("control server error", err)
+		}
+	}
 
 	l, err := net.Listen("tcp", config.ListenAddr)
 	if err != nil {
@@ -94,7 +132,59 @@ func main() {
 	}
 }
 
-func handleClientRequest(conn net.Conn) {
+//newServers the servers of config.Servers, or the single server of the
+//legacy ServerAddr, Channel, Client and FakeWebDomain
+func newServers(cfg *appConfig) (*serverGroup, error) {
+	infos := cfg.Servers
+	if len(infos) == 0 {
+		infos = []serverInfo{{
+			ServerAddr:    cfg.ServerAddr,
+			Channel:       cfg.Channel,
+			Client:        cfg.Client,
+			FakeWebDomain: cfg.FakeWebDomain,
+			LegacyHello:   cfg.LegacyHello,
+			KeyType:       cfg.KeyType,
+		}}
+	}
+
+	certDir := cfg.CertCacheDir
+	if certDir == "" {
+		certDir = "certs"
+	}
+	keepalive := newKeepaliveConfig(cfg.PingInterval, cfg.MaxMissedPongs)
+	certs := make(map[string]faketls.Certificate)
+	var pools []*sessionPool
+	for _, info := range infos {
+		if info.Name == "" {
+			info.Name = info.ServerAddr
+		}
+		channelUUID, err := uuid.Parse(info.Channel)
+		if err != nil {
+			return nil, fmt.Errorf("server %v parse channel uuid error: %v", info.Name, err)
+		}
+		clientUUID, err := uuid.Parse(info.Client)
+		if err != nil {
+			return nil, fmt.Errorf("server %v parse client uuid error: %v", info.Name, err)
+		}
+		certKey := clientUUID.String() + info.KeyType
+		cert, ok := certs[certKey]
+		if !ok {
+			cert, err = crypto.LoadOrCreateKeyPair(certDir, clientUUID[:], info.KeyType)
+			if err != nil {
+				return nil, fmt.Errorf("server %v create key pair error: %v", info.Name, err)
+			}
+			certs[certKey] = cert
+		}
+		var pool *sessionPool
+		pools = append(pools, pool.newSessionPool(info.Name, info.ServerAddr, info.FakeWebDomain, cert, channelUUID[:], clientUUID[:], info.LegacyHello, keepalive))
+	}
+	return newServerGroup(pools, cfg.SelectPolicy, time.Duration(cfg.ProbeInterval)*time.Second)
+}
+
+func handleClientRequest(c net.Conn) {
+	conn := connections.add(c)
+	defer connections.remove(conn)
+
 	firstPacket := make([]byte, 4096)
 	n, err := conn.Read(firstPacket)
 	if err != nil {
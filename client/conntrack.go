@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//proxy frontends
+const (
+	frontendSOCKS5 = "socks5"
+	frontendHTTP   = "http"
+)
+
+var connSeq uint64
+
+//trackedConn a proxy connection of a local application, bytes read from it
+//are counted as up and bytes written to it as down
+type trackedConn struct {
+	net.Conn
+	bytesUp   uint64
+	bytesDown uint64
+	id        uint64
+	tmStart   time.Time
+
+	mutex    sync.Mutex
+	frontend string
+	target   string
+	action   routeAction
+	server   string
+	session  uint64
+	streamID uint16
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.addUp(n)
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.addDown(n)
+	return n, err
+}
+
+//CloseWrite shut down the write side of a tcp connection
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) addUp(n int) {
+	atomic.AddUint64(&c.bytesUp, uint64(n))
+}
+
+func (c *trackedConn) addDown(n int) {
+	atomic.AddUint64(&c.bytesDown, uint64(n))
+}
+
+//setRequest the target of the current request, a keep-alive http connection has several
+func (c *trackedConn) setRequest(frontend, target string, action routeAction) {
+	c.mutex.Lock()
+	c.frontend = frontend
+	c.target = target
+	c.action = action
+	c.server = ""
+	c.session = 0
+	c.streamID = 0
+	c.mutex.Unlock()
+}
+
+func (c *trackedConn) setStream(sess *session, streamID uint16) {
+	c.mutex.Lock()
+	c.server = sess.name
+	c.session = sess.id
+	c.streamID = streamID
+	c.mutex.Unlock()
+}
+
+//connTable the proxy connections that are open
+type connTable struct {
+	mutex sync.Mutex
+	conns map[uint64]*trackedConn
+}
+
+var connections = &connTable{conns: make(map[uint64]*trackedConn, 64)}
+
+func (t *connTable) add(conn net.Conn) *trackedConn {
+	c := &trackedConn{Conn: conn, id: atomic.AddUint64(&connSeq, 1), tmStart: time.Now()}
+	t.mutex.Lock()
+	t.conns[c.id] = c
+	t.mutex.Unlock()
+	return c
+}
+
+func (t *connTable) remove(c *trackedConn) {
+	t.mutex.Lock()
+	delete(t.conns, c.id)
+	t.mutex.Unlock()
+}
+
+func (t *connTable) get(id uint64) (*trackedConn, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c, ok := t.conns[id]
+	return c, ok
+}
+
+func (t *connTable) list() []*trackedConn {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ptrbug/invis/metrics"
+)
+
+//controlConfig the local control http api, without a Token reading is open
+//and a token for the requests changing state is generated at startup
+type controlConfig struct {
+	ListenAddr string
+	Token      string
+}
+
+type controlConn struct {
+	ID        uint64
+	Frontend  string
+	Target    string
+	Route     routeAction
+	Server    string
+	Session   uint64
+	Stream    uint16
+	BytesUp   uint64
+	BytesDown uint64
+	Duration  int64
+}
+
+type controlServer struct {
+	Name    string
+	Addr    string
+	Healthy bool
+	RTT     int64
+	Session uint64
+	Version byte
+	Streams int
+	Active  bool
+}
+
+type controlServers struct {
+	Policy  selectPolicy
+	Active  string
+	Servers []controlServer
+}
+
+type controlRouting struct {
+	Mode string
+}
+
+type controlStats struct {
+	BytesUp     uint64
+	BytesDown   uint64
+	Sessions    int
+	Streams     int
+	Connections int
+}
+
+//listenLocal only loopback addresses are allowed, for control and metrics
+func listenLocal(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("listen address %v is not loopback", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+//controlCookie carries a generated token to the dashboard, SameSite keeps
+//other sites from sending it
+const controlCookie = "invis-control"
+
+//loopbackHost whether the Host of a request names a loopback address, a page
+//of another site reaching the api through dns rebinding has its own name
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func newControlToken() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+func runControlServ(cfg controlConfig) error {
+	ln, err := listenLocal(cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	token, readOpen := cfg.Token, cfg.Token == ""
+	cookie := ""
+	if readOpen {
+		if token, err = newControlToken(); err != nil {
+			return err
+		}
+		cookie = token
+		loger.Printf("control token %v\n", token)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/connections", handleControlConnections)
+	mux.HandleFunc("/api/connections/", handleControlConnections)
+	mux.HandleFunc("/api/servers", handleControlServers)
+	mux.HandleFunc("/api/servers/", handleControlServers)
+	mux.HandleFunc("/api/routing", handleControlRouting)
+	mux.HandleFunc("/api/stats", handleControlStats)
+	mux.HandleFunc("/api/errors", handleControlErrors)
+	mux.Handle("/metrics", metrics.Handler())
+
+	root := http.NewServeMux()
+	root.Handle("/", dashboardHandler(cookie))
+	root.Handle("/api/", controlAuth(token, readOpen, mux))
+	root.Handle("/metrics", controlAuth(token, readOpen, mux))
+	go http.Serve(ln, controlHost(root))
+	return nil
+}
+
+//controlHost refuse requests whose Host is not a loopback address
+func controlHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !loopbackHost(r.Host) {
+			http.Error(w, "forbidden host", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//controlAuth every request changing state needs the token, reading too unless readOpen.
+//The token is a bearer token or the cookie of the dashboard
+func controlAuth(token string, readOpen bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if readOpen && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if got == "" {
+			if c, err := r.Cookie(controlCookie); err == nil {
+				got = c.Value
+			}
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+//pathParts the parts of the path after prefix
+func pathParts(path, prefix string) []string {
+	path = strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func handleControlConnections(w http.ResponseWriter, r *http.Request) {
+	parts := pathParts(r.URL.Path, "/api/connections")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 0:
+		now := time.Now()
+		conns := []controlConn{}
+		for _, c := range connections.list() {
+			c.mutex.Lock()
+			conns = append(conns, controlConn{ID: c.id,
+				Frontend:  c.frontend,
+				Target:    c.target,
+				Route:     c.action,
+				Server:    c.server,
+				Session:   c.session,
+				Stream:    c.streamID,
+				BytesUp:   atomic.LoadUint64(&c.bytesUp),
+				BytesDown: atomic.LoadUint64(&c.bytesDown),
+				Duration:  int64(now.Sub(c.tmStart).Seconds()),
+			})
+			c.mutex.Unlock()
+		}
+		sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+		writeJSON(w, conns)
+
+	case r.Method == http.MethodDelete && len(parts) == 1:
+		id, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c, ok := connections.get(id)
+		if !ok {
+			http.Error(w, "connection not found", http.StatusNotFound)
+			return
+		}
+		c.Close()
+		loger.Printf("control close connection %v to %v\n", id, c.target)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func handleControlServers(w http.ResponseWriter, r *http.Request) {
+	parts := pathParts(r.URL.Path, "/api/servers")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 0:
+		active := servers.getActive()
+		list := controlServers{Policy: servers.policy, Servers: []controlServer{}}
+		if active != nil {
+			list.Active = active.name
+		}
+		for _, p := range servers.pools {
+			s := controlServer{Name: p.name,
+				Addr:    p.serverAddr,
+				Healthy: p.healthy(),
+				RTT:     int64(p.getRTT() / time.Millisecond),
+				Active:  p == active,
+			}
+			if sess := p.getSession(); sess != nil {
+				s.Session = sess.id
+				s.Version = sess.getSettings().Version
+				s.Streams = sess.streamCount()
+			}
+			list.Servers = append(list.Servers, s)
+		}
+		writeJSON(w, list)
+
+	case r.Method == http.MethodPut && len(parts) == 1 && parts[0] == "active":
+		req := struct{ Name string }{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := servers.setActive(req.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		loger.Printf("control set active server %q\n", req.Name)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "reconnect":
+		p := servers.find(parts[0])
+		if p == nil {
+			http.Error(w, "server not found", http.StatusNotFound)
+			return
+		}
+		p.reconnect()
+		loger.Printf("control reconnect server %v\n", p.name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func handleControlRouting(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, controlRouting{Mode: routing.getMode()})
+
+	case http.MethodPut:
+		req := controlRouting{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := routing.setMode(req.Mode); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		loger.Printf("control set routing mode %v\n", req.Mode)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func handleControlStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, controlStats{BytesUp: uint64(bytesUp.Value()),
+		BytesDown:   uint64(bytesDown.Value()),
+		Sessions:    int(sessionsActive.Value()),
+		Streams:     int(streamsActive.Value()),
+		Connections: len(connections.list()),
+	})
+}
+
+func handleControlErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, recentErrors.list())
+}
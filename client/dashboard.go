@@ -0,0 +1,25 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//dashboardFiles the dashboard page served at / of the control api, it polls the api every second
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+//dashboardHandler the page is public, the api calls it makes carry the token.
+//A generated token is handed to the page as a cookie, a configured one is asked for
+func dashboardHandler(cookie string) http.Handler {
+	files, _ := fs.Sub(dashboardFiles, "dashboard")
+	server := http.FileServer(http.FS(files))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" && cookie != "" {
+			http.SetCookie(w, &http.Cookie{Name: controlCookie, Value: cookie, Path: "/",
+				HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		}
+		server.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,127 @@
+var token = localStorage.getItem("invis-token") || "";
+var last = null;
+var timer = null;
+
+function api(method, path, body) {
+  var opts = {method: method, headers: {}};
+  if (token) opts.headers["Authorization"] = "Bearer " + token;
+  if (body !== undefined) opts.body = JSON.stringify(body);
+  return fetch(path, opts).then(function (r) {
+    if (r.status === 401) {
+      var err = new Error("unauthorized");
+      err.unauthorized = true;
+      throw err;
+    }
+    if (!r.ok) return r.text().then(function (t) { throw new Error(t); });
+    return r.status === 204 ? null : r.json();
+  });
+}
+
+function esc(s) {
+  return String(s).replace(/[&<>"]/g, function (c) {
+    return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c];
+  });
+}
+
+function bytes(n) {
+  var units = ["B", "KB", "MB", "GB", "TB"], i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return (i ? n.toFixed(1) : n) + " " + units[i];
+}
+
+function duration(s) {
+  if (s < 60) return s + "s";
+  if (s < 3600) return Math.floor(s / 60) + "m" + (s % 60) + "s";
+  return Math.floor(s / 3600) + "h" + Math.floor(s % 3600 / 60) + "m";
+}
+
+// polling stops at the first 401, the token is asked for once and polling
+// resumes only after one was entered
+function unauthorized() {
+  if (timer === null) return;
+  clearInterval(timer);
+  timer = null;
+  token = prompt("Control token") || "";
+  localStorage.setItem("invis-token", token);
+  if (token) {
+    start();
+  } else {
+    document.getElementById("status").innerHTML = "unauthorized <button id=\"login\">Enter token</button>";
+  }
+}
+
+function start() {
+  if (timer !== null) return;
+  timer = setInterval(refresh, 1000);
+  refresh();
+}
+
+function refresh() {
+  Promise.all([api("GET", "/api/stats"), api("GET", "/api/servers"), api("GET", "/api/connections"),
+    api("GET", "/api/errors"), api("GET", "/api/routing")]).then(function (res) {
+    var stats = res[0], servers = res[1], conns = res[2], errors = res[3], routing = res[4];
+    var now = Date.now();
+    if (last) {
+      var secs = (now - last.time) / 1000;
+      document.getElementById("rateUp").textContent = bytes(Math.max(0, (stats.BytesUp - last.up) / secs)) + "/s";
+      document.getElementById("rateDown").textContent = bytes(Math.max(0, (stats.BytesDown - last.down) / secs)) + "/s";
+    }
+    last = {time: now, up: stats.BytesUp, down: stats.BytesDown};
+
+    var current = null;
+    servers.Servers.forEach(function (s) {
+      if (!current && (servers.Active ? s.Active : s.Session)) current = s;
+    });
+    document.getElementById("server").textContent = current ? current.Name : "-";
+    document.getElementById("latency").textContent = current && current.RTT ? current.RTT + " ms" : "-";
+    document.getElementById("connCount").textContent = conns.length;
+
+    document.querySelectorAll("button[data-mode]").forEach(function (b) {
+      b.className = b.getAttribute("data-mode") === routing.Mode ? "on" : "";
+    });
+
+    document.getElementById("servers").innerHTML = servers.Servers.map(function (s) {
+      return "<tr><td>" + esc(s.Name) + "</td><td>" + esc(s.Addr) + "</td>" +
+        "<td class=\"" + (s.Healthy ? "up\">up" : "down\">down") + "</td>" +
+        "<td>" + (s.RTT ? s.RTT + " ms" : "-") + "</td><td>" + s.Streams + "</td>" +
+        "<td><button data-reconnect=\"" + esc(s.Name) + "\">Reconnect</button></td>" +
+        "<td><button data-active=\"" + (s.Active ? "" : esc(s.Name)) + "\"" + (s.Active ? " class=\"on\"" : "") + ">" +
+        (s.Active ? "Pinned" : "Use only") + "</button></td></tr>";
+    }).join("");
+
+    document.getElementById("conns").innerHTML = conns.map(function (c) {
+      return "<tr><td>" + c.ID + "</td><td>" + esc(c.Frontend) + "</td><td>" + esc(c.Target) + "</td>" +
+        "<td>" + esc(c.Route) + "</td><td>" + esc(c.Server) + "</td>" +
+        "<td>" + bytes(c.BytesUp) + "</td><td>" + bytes(c.BytesDown) + "</td><td>" + duration(c.Duration) + "</td>" +
+        "<td><button data-close=\"" + c.ID + "\">Close</button></td></tr>";
+    }).join("");
+
+    document.getElementById("errors").innerHTML = errors.map(function (e) {
+      return "<tr><td>" + esc(new Date(e.Time).toLocaleTimeString()) + "</td><td>" + esc(e.Message) + "</td></tr>";
+    }).join("");
+    document.getElementById("status").textContent = "";
+  }).catch(function (e) {
+    if (e.unauthorized) return unauthorized();
+    document.getElementById("status").textContent = "client not reachable: " + e.message;
+  });
+}
+
+document.addEventListener("click", function (e) {
+  var b = e.target, req = null;
+  if (b.id === "login") {
+    token = prompt("Control token") || "";
+    localStorage.setItem("invis-token", token);
+    if (token) start();
+    return;
+  }
+  if (b.hasAttribute("data-mode")) req = api("PUT", "/api/routing", {Mode: b.getAttribute("data-mode")});
+  else if (b.hasAttribute("data-reconnect")) req = api("POST", "/api/servers/" + encodeURIComponent(b.getAttribute("data-reconnect")) + "/reconnect");
+  else if (b.hasAttribute("data-active")) req = api("PUT", "/api/servers/active", {Name: b.getAttribute("data-active")});
+  else if (b.hasAttribute("data-close")) req = api("DELETE", "/api/connections/" + b.getAttribute("data-close"));
+  if (req) req.then(refresh, function (err) {
+    if (err.unauthorized) return unauthorized();
+    alert(err.message);
+  });
+});
+
+start();
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/ptrbug/invis/proto"
+)
+
+const directDialTimeout = time.Second * 10
+
+//dialDirect connect addr without the tunnel
+func dialDirect(addr *proto.SOCKS5Address) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr.String(), directDialTimeout)
+	if err != nil {
+		streamOpenFailures.With("direct_dial").Inc()
+		reportError("direct connect error, %v", err)
+	}
+	return conn, err
+}
+
+//relayDirect copy between the local connection and a direct connection, the
+//end of one direction only shuts down writing, both are closed when both ended
+func relayDirect(conn net.Conn, reader io.Reader, remote net.Conn) {
+	defer remote.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := io.Copy(conn, remote)
+		if cw, ok := conn.(closeWriter); ok && err == nil {
+			cw.CloseWrite()
+			return
+		}
+		conn.Close()
+	}()
+	_, err := io.Copy(remote, reader)
+	if cw, ok := remote.(closeWriter); ok && err == nil {
+		cw.CloseWrite()
+		<-done
+		return
+	}
+	remote.Close()
+	<-done
+}
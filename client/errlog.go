@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const maxRecentErrors = 50
+
+type recentError struct {
+	Time    time.Time
+	Message string
+}
+
+//errorLog the latest errors for the dashboard, older ones are only in log.txt
+type errorLog struct {
+	mutex  sync.Mutex
+	errors []recentError
+}
+
+var recentErrors = &errorLog{}
+
+//reportError write to log.txt and keep it as a recent error
+func reportError(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	loger.Output(2, msg+"\n")
+	recentErrors.mutex.Lock()
+	recentErrors.errors = append(recentErrors.errors, recentError{Time: time.Now(), Message: msg})
+	if len(recentErrors.errors) > maxRecentErrors {
+		recentErrors.errors = recentErrors.errors[len(recentErrors.errors)-maxRecentErrors:]
+	}
+	recentErrors.mutex.Unlock()
+}
+
+//list newest first
+func (l *errorLog) list() []recentError {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	errors := make([]recentError, 0, len(l.errors))
+	for i := len(l.errors) - 1; i >= 0; i-- {
+		errors = append(errors, l.errors[i])
+	}
+	return errors
+}
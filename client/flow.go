@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+
+	"github.com/ptrbug/invis/proto"
+)
+
+//streamFlow the windows of a stream with flow control, the data from the
+//server is written to the application by its own goroutine, so a slow
+//reader only stalls its own stream
+type streamFlow struct {
+	send      *proto.SendWindow
+	recv      *proto.RecvWindow
+	buffer    *proto.StreamBuffer
+	halfClose bool
+	//fin the server sent STREAM_FIN
+	fin int32
+	//recvDone closed when nothing more is written to the application
+	recvDone chan struct{}
+}
+
+//closeWriter implemented by tcp connections
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func (flow *streamFlow) close() {
+	flow.send.Close()
+	flow.buffer.Close()
+}
+
+//newFlow called before the STREAM_NEW of the stream is sent
+func (sess *session) newFlow(streamID uint16, halfClose bool) {
+	flow := &streamFlow{send: proto.NewSendWindow(),
+		recv:      proto.NewRecvWindow(),
+		buffer:    proto.NewStreamBuffer(),
+		halfClose: halfClose,
+		recvDone:  make(chan struct{})}
+	sess.mutex.Lock()
+	conn, ok := sess.clients[streamID]
+	if ok {
+		sess.flows[streamID] = flow
+	}
+	sess.mutex.Unlock()
+	if ok {
+		go sess.writeFlow(streamID, flow, conn)
+	}
+}
+
+func (sess *session) getFlow(streamID uint16) *streamFlow {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+	return sess.flows[streamID]
+}
+
+//writeFlow the connection is closed once the stream ended and its data is
+//written, after a STREAM_FIN only its write side is shut down
+func (sess *session) writeFlow(streamID uint16, flow *streamFlow, conn io.WriteCloser) {
+	defer close(flow.recvDone)
+	for {
+		data, ok := flow.buffer.Pop()
+		if !ok {
+			if atomic.LoadInt32(&flow.fin) == 0 {
+				conn.Close()
+			} else if cw, ok := conn.(closeWriter); ok {
+				cw.CloseWrite()
+			} else {
+				//an http origin ends its response by closing
+				conn.Close()
+				sess.writeServerStreamDel(streamID)
+			}
+			return
+		}
+		_, err := conn.Write(data)
+		if err != nil {
+			conn.Close()
+			sess.writeServerStreamDel(streamID)
+			return
+		}
+		if increment := flow.recv.Consume(len(data)); increment > 0 {
+			if sess.writeServerWindowUpdate(streamID, increment) != nil {
+				return
+			}
+		}
+	}
+}
+
+//pushFlow called by the agent instead of writing to the application
+func (sess *session) pushFlow(streamID uint16, flow *streamFlow, data []byte) {
+	if !flow.recv.Receive(len(data)) {
+		loger.Printf("server %v stream %v exceeded its window\n", sess.name, streamID)
+		sess.writeServerStreamDel(streamID)
+		sess.delStream(streamID)
+		return
+	}
+	flow.buffer.Push(append([]byte(nil), data...))
+}
+
+//finStream the server sends nothing more on the stream
+func (sess *session) finStream(streamID uint16) {
+	flow := sess.getFlow(streamID)
+	if flow == nil || !flow.halfClose {
+		return
+	}
+	atomic.StoreInt32(&flow.fin, 1)
+	flow.buffer.Close()
+}
+
+func (sess *session) writeServerStreamFin(streamID uint16) error {
+	sess.flushShaper(streamID)
+	var buffer [proto.HeadLength]byte
+	head := proto.MessageHead{}
+	head.StreamType = proto.STREAM_FIN
+	head.ProtoType = proto.TCP_PROTO
+	head.StreamID = streamID
+	head.BodyLength = 0
+	head.Encode(buffer[:])
+	return sess.writeServer(buffer[:])
+}
+
+func (sess *session) windowUpdate(streamID uint16, body []byte) {
+	if len(body) < proto.WindowUpdateLength {
+		return
+	}
+	if flow := sess.getFlow(streamID); flow != nil {
+		flow.send.Grant(binary.BigEndian.Uint32(body))
+	}
+}
+
+func (sess *session) writeServerWindowUpdate(streamID uint16, increment uint32) error {
+	var buffer [proto.HeadLength + proto.WindowUpdateLength]byte
+	head := proto.MessageHead{}
+	head.StreamType = proto.STREAM_WINDOW_UPDATE
+	head.ProtoType = proto.TCP_PROTO
+	head.StreamID = streamID
+	head.BodyLength = proto.WindowUpdateLength
+	head.Encode(buffer[:])
+	binary.BigEndian.PutUint32(buffer[proto.HeadLength:], increment)
+	return sess.writeServer(buffer[:])
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//privateCIDRs the builtin geoip:private, used when there is no private.txt
+var privateCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+type ipRange struct {
+	start net.IP
+	end   net.IP
+}
+
+//ipRangeSet sorted and merged ip ranges, all addresses in 16 byte form
+type ipRangeSet []ipRange
+
+func newIPRangeSet(cidrs []*net.IPNet) ipRangeSet {
+	set := make(ipRangeSet, 0, len(cidrs))
+	for _, ipNet := range cidrs {
+		start := ipNet.IP.To16()
+		mask := ipNet.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.IPMask(bytes.Repeat([]byte{0xff}, net.IPv6len-net.IPv4len)), mask...)
+		}
+		end := make(net.IP, net.IPv6len)
+		for i := range end {
+			end[i] = start[i] | ^mask[i]
+		}
+		set = append(set, ipRange{start: start.Mask(mask), end: end})
+	}
+	sort.Slice(set, func(i, j int) bool {
+		return bytes.Compare(set[i].start, set[j].start) < 0
+	})
+
+	merged := set[:0]
+	for _, r := range set {
+		last := len(merged) - 1
+		if last >= 0 && bytes.Compare(r.start, merged[last].end) <= 0 {
+			if bytes.Compare(r.end, merged[last].end) > 0 {
+				merged[last].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func (set ipRangeSet) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	i := sort.Search(len(set), func(i int) bool {
+		return bytes.Compare(set[i].end, ip) >= 0
+	})
+	return i < len(set) && bytes.Compare(set[i].start, ip) <= 0
+}
+
+//parseCIDRList one cidr or ip per line, # starts a comment
+func parseCIDRList(data []byte) (interface{}, error) {
+	var cidrs []*net.IPNet
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if index := strings.IndexByte(text, '#'); index != -1 {
+			text = strings.TrimSpace(text[:index])
+		}
+		if text == "" {
+			continue
+		}
+		if strings.IndexByte(text, '/') == -1 {
+			ip := net.ParseIP(text)
+			if ip == nil {
+				return nil, fmt.Errorf("line %d: invalid ip %v", line, text)
+			}
+			bits := net.IPv6len * 8
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = net.IPv4len * 8
+			}
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		cidrs = append(cidrs, ipNet)
+	}
+	return newIPRangeSet(cidrs), scanner.Err()
+}
+
+func parseMMDB(data []byte) (interface{}, error) {
+	return newMMDBReader(data)
+}
+
+//newGeoIPMatcher match the ips of country code, from <GeoIPDir>/<code>.txt
+//if it exists, otherwise from the maxmind database GeoIPFile. private is builtin
+func newGeoIPMatcher(cfg *routingConfig, files *ruleFiles, code string) (func(ip net.IP) bool, error) {
+	code = strings.ToLower(code)
+	if cfg.GeoIPDir != "" {
+		path := filepath.Join(cfg.GeoIPDir, code+".txt")
+		if _, err := os.Stat(path); err == nil {
+			f, err := files.open(path, parseCIDRList)
+			if err != nil {
+				return nil, err
+			}
+			return func(ip net.IP) bool {
+				return f.get().(ipRangeSet).contains(ip)
+			}, nil
+		}
+	}
+
+	if code == "private" {
+		set, _ := parseCIDRList([]byte(strings.Join(privateCIDRs, "\n")))
+		return func(ip net.IP) bool {
+			return set.(ipRangeSet).contains(ip)
+		}, nil
+	}
+
+	if cfg.GeoIPFile != "" {
+		f, err := files.open(cfg.GeoIPFile, parseMMDB)
+		if err != nil {
+			return nil, err
+		}
+		return func(ip net.IP) bool {
+			return f.get().(*mmdbReader).country(ip) == code
+		}, nil
+	}
+	return nil, fmt.Errorf("no geoip data for %v", code)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+//privateDomains the builtin geosite:private, used when there is no private.txt
+var privateDomains = []string{
+	"localhost",
+	"local",
+	"lan",
+	"localdomain",
+	"home.arpa",
+	"in-addr.arpa",
+	"ip6.arpa",
+}
+
+//domainSet a domain list, every line of the file is one of
+//  example.com            example.com and its subdomains
+//  domain:example.com     the same as above
+//  full:www.example.com   only www.example.com
+//  keyword:example        domains containing example
+//  regexp:^ex.*\.com$     domains matching the regular expression
+type domainSet struct {
+	full     map[string]bool
+	suffix   map[string]bool
+	keywords []string
+	regexps  []*regexp.Regexp
+}
+
+func (set *domainSet) contains(domain string) bool {
+	if set.full[domain] {
+		return true
+	}
+	for d := domain; d != ""; {
+		if set.suffix[d] {
+			return true
+		}
+		index := strings.IndexByte(d, '.')
+		if index == -1 {
+			break
+		}
+		d = d[index+1:]
+	}
+	for _, keyword := range set.keywords {
+		if strings.Contains(domain, keyword) {
+			return true
+		}
+	}
+	for _, re := range set.regexps {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseDomainList(data []byte) (interface{}, error) {
+	set := &domainSet{full: make(map[string]bool), suffix: make(map[string]bool)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if index := strings.IndexByte(text, '#'); index != -1 {
+			text = strings.TrimSpace(text[:index])
+		}
+		if text == "" {
+			continue
+		}
+
+		kind := "domain"
+		if index := strings.IndexByte(text, ':'); index != -1 {
+			kind, text = text[:index], strings.TrimSpace(text[index+1:])
+		}
+		switch kind {
+		case "domain":
+			set.suffix[strings.ToLower(strings.Trim(text, "."))] = true
+		case "full":
+			set.full[strings.ToLower(text)] = true
+		case "keyword":
+			set.keywords = append(set.keywords, strings.ToLower(text))
+		case "regexp":
+			re, err := regexp.Compile(text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			set.regexps = append(set.regexps, re)
+		default:
+			return nil, fmt.Errorf("line %d: unknown type %v", line, kind)
+		}
+	}
+	return set, scanner.Err()
+}
+
+//newGeoSiteMatcher match the domains of list name, from <GeoSiteDir>/<name>.txt
+func newGeoSiteMatcher(cfg *routingConfig, files *ruleFiles, name string) (func(domain string) bool, error) {
+	name = strings.ToLower(name)
+	if cfg.GeoSiteDir != "" {
+		path := filepath.Join(cfg.GeoSiteDir, name+".txt")
+		if _, err := os.Stat(path); err == nil {
+			f, err := files.open(path, parseDomainList)
+			if err != nil {
+				return nil, err
+			}
+			return func(domain string) bool {
+				return f.get().(*domainSet).contains(domain)
+			}, nil
+		}
+	}
+
+	if name == "private" {
+		set, _ := parseDomainList([]byte(strings.Join(privateDomains, "\n")))
+		return set.(*domainSet).contains, nil
+	}
+	return nil, fmt.Errorf("no geosite data for %v", name)
+}
@@ -1,107 +1,341 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"net"
-	"net/url"
+	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/ptrbug/invis/proto"
 )
 
-func handleHTTPRequest(conn net.Conn, firstPacket []byte) {
+const proxyAuthRequired = "HTTP/1.1 407 Proxy Authentication Required\r\n" +
+	"Proxy-Authenticate: Basic realm=\"invis\"\r\n" +
+	"Content-Length: 0\r\n" +
+	"Connection: close\r\n\r\n"
+
+const forbidden = "HTTP/1.1 403 Forbidden\r\n" +
+	"Content-Length: 0\r\n" +
+	"Connection: close\r\n\r\n"
+
+const badGateway = "HTTP/1.1 502 Bad Gateway\r\n" +
+	"Content-Length: 0\r\n" +
+	"Connection: close\r\n\r\n"
+
+const gatewayTimeout = "HTTP/1.1 504 Gateway Timeout\r\n" +
+	"Content-Length: 0\r\n" +
+	"Connection: close\r\n\r\n"
+
+const badRequest = "HTTP/1.1 400 Bad Request\r\n" +
+	"Content-Length: 0\r\n" +
+	"Connection: close\r\n\r\n"
+
+//hopHeaders headers only meaningful for a single connection, never forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func handleHTTPRequest(conn *trackedConn, firstPacket []byte) {
 	defer conn.Close()
 
-	var method, rawurl, host string
-	var port int
-	index := bytes.IndexByte(firstPacket, '\n')
-	if index == -1 {
-		return
-	}
-	fmt.Sscanf(string(firstPacket), "%s%s", &method, &rawurl)
-	if method == "CONNECT" {
-		xhost, xport, err := net.SplitHostPort(rawurl)
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(firstPacket), conn))
+	forwarder := newHTTPForwarder(conn)
+	defer forwarder.close()
+
+	for {
+		req, err := http.ReadRequest(reader)
 		if err != nil {
 			return
 		}
-		host = xhost
-		port, err = strconv.Atoi(xport)
-		if err != nil {
+
+		if auth.required() && !auth.checkBasic(req.Header.Get("Proxy-Authorization")) {
+			fmt.Fprint(conn, proxyAuthRequired)
 			return
 		}
-	} else {
-		URL, err := url.Parse(rawurl)
-		if err != nil {
+
+		addr, ok := requestAddress(req)
+		if !ok {
+			fmt.Fprint(conn, badRequest)
 			return
 		}
 
-		xhost, xport, err := net.SplitHostPort(URL.Host)
-		if err != nil {
-			host = URL.Host
-			port = 80
-		} else {
-			host = xhost
-			port, err = strconv.Atoi(xport)
-			if err != nil {
-				return
-			}
+		action := routing.route(addr)
+		conn.setRequest(frontendHTTP, addr.String(), action)
+		if action == routeBlock {
+			fmt.Fprint(conn, forbidden)
+			return
+		}
+
+		if req.Method == http.MethodConnect {
+			handleHTTPConnect(conn, reader, addr, action)
+			return
+		}
+
+		if !forwarder.forward(req, addr, action, reader) {
+			return
 		}
 	}
+}
 
-	sess, streamID := pool.getSessonAndStream(conn)
-	if sess == nil {
-		return
+//httpErrorResponse the response for a stream the server could not open
+func httpErrorResponse(code proto.ReplyCode) string {
+	switch code {
+	case proto.REPLY_DENIED:
+		return forbidden
+	case proto.REPLY_TIMEOUT:
+		return gatewayTimeout
+	}
+	return badGateway
+}
+
+func requestAddress(req *http.Request) (*proto.SOCKS5Address, bool) {
+	host := req.URL.Hostname()
+	if host == "" {
+		return nil, false
+	}
+	port := 80
+	if req.URL.Port() != "" {
+		var err error
+		port, err = strconv.Atoi(req.URL.Port())
+		if err != nil {
+			return nil, false
+		}
+	} else if req.Method == http.MethodConnect {
+		return nil, false
 	}
-	defer sess.delStream(streamID)
 
 	addr := &proto.SOCKS5Address{}
 	addr.AddressType = proto.DOMAINNAME
 	addr.FQDN = host
 	addr.Port = uint16(port)
-	err := sess.writeServerStreamNew(addr, streamID)
-	if err != nil {
-		return
-	}
+	return addr, true
+}
 
-	if method == "CONNECT" {
-		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
-	} else {
-		var header [proto.HeadLength]byte
-		head := proto.MessageHead{}
-		head.StreamType = proto.STREAM_DATA
-		head.ProtoType = proto.TCP_PROTO
-		head.StreamID = streamID
-		head.BodyLength = uint16(len(firstPacket))
-		head.Encode(header[:])
-		err := sess.writeServer(header[:])
+func handleHTTPConnect(conn *trackedConn, reader io.Reader, addr *proto.SOCKS5Address, action routeAction) {
+	if action == routeDirect {
+		remote, err := dialDirect(addr)
 		if err != nil {
+			fmt.Fprint(conn, badGateway)
 			return
 		}
-		err = sess.writeServer(firstPacket)
-		if err != nil {
-			return
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		relayDirect(conn, reader, remote)
+		return
+	}
+
+	sess, streamID := servers.getSessonAndStream(conn)
+	if sess == nil {
+		fmt.Fprint(conn, badGateway)
+		return
+	}
+	defer sess.delStream(streamID)
+	conn.setStream(sess, streamID)
+
+	code := sess.openStream(streamID, addr, func(code proto.ReplyCode) {
+		if code == proto.REPLY_SUCCEEDED {
+			fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		} else {
+			fmt.Fprint(conn, httpErrorResponse(code))
 		}
+	})
+	if code != proto.REPLY_SUCCEEDED {
+		return
 	}
+	sess.forward(streamID, reader)
+}
 
-	buffer := make([]byte, proto.MaxMessageSize)
+//httpTarget the stream or direct connection to one origin server of a proxy
+//connection, the responses of the origin are written to the proxy connection
+type httpTarget struct {
+	forwarder *httpForwarder
+	sess      *session
+	streamID  uint16
+	direct    net.Conn
+	closed    int32
+}
 
-	for {
-		n, err := conn.Read(buffer[proto.HeadLength:])
-		if err != nil {
-			sess.writeServerStreamDel(streamID)
-			return
+func (t *httpTarget) writer() io.Writer {
+	if t.direct != nil {
+		return t.direct
+	}
+	return &streamWriter{sess: t.sess, streamID: t.streamID}
+}
+
+func (t *httpTarget) isOpen() bool {
+	return atomic.LoadInt32(&t.closed) == 0
+}
+
+func (t *httpTarget) Write(data []byte) (int, error) {
+	return t.forwarder.conn.Write(data)
+}
+
+//Close only the origin of the last request may still be sending a
+//response delimited by closing the connection
+func (t *httpTarget) Close() error {
+	atomic.StoreInt32(&t.closed, 1)
+	if t.forwarder.isCurrent(t) {
+		return t.forwarder.conn.Close()
+	}
+	return nil
+}
+
+//httpForwarder forward the plain http requests of one keep-alive proxy connection,
+//every origin gets its own stream which is reused by later requests to it
+type httpForwarder struct {
+	conn    *trackedConn
+	targets map[string]*httpTarget
+
+	mutex   sync.Mutex
+	current *httpTarget
+}
+
+func newHTTPForwarder(conn *trackedConn) *httpForwarder {
+	return &httpForwarder{conn: conn, targets: make(map[string]*httpTarget, 4)}
+}
+
+func (f *httpForwarder) isCurrent(t *httpTarget) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.current == t
+}
+
+func (f *httpForwarder) setCurrent(t *httpTarget) {
+	f.mutex.Lock()
+	f.current = t
+	f.mutex.Unlock()
+}
+
+//getTarget the reply code tells why there is no target
+func (f *httpForwarder) getTarget(addr *proto.SOCKS5Address, action routeAction) (*httpTarget, proto.ReplyCode) {
+	key := addr.String()
+	t, ok := f.targets[key]
+	if ok && t.isOpen() {
+		if t.sess != nil {
+			f.conn.setStream(t.sess, t.streamID)
 		}
+		return t, proto.REPLY_SUCCEEDED
+	}
+	delete(f.targets, key)
 
-		head := proto.MessageHead{}
-		head.StreamType = proto.STREAM_DATA
-		head.ProtoType = proto.TCP_PROTO
-		head.StreamID = streamID
-		head.BodyLength = uint16(n)
-		head.Encode(buffer[0:proto.HeadLength])
-		err = sess.writeServer(buffer[:proto.HeadLength+n])
+	t = &httpTarget{forwarder: f}
+	if action == routeDirect {
+		remote, err := dialDirect(addr)
 		if err != nil {
-			return
+			return nil, proto.REPLY_FAILURE
+		}
+		t.direct = remote
+		go func() {
+			io.Copy(t, remote)
+			t.Close()
+		}()
+		f.targets[key] = t
+		return t, proto.REPLY_SUCCEEDED
+	}
+
+	sess, streamID := servers.getSessonAndStream(t)
+	if sess == nil {
+		return nil, proto.REPLY_FAILURE
+	}
+	t.sess = sess
+	t.streamID = streamID
+	f.conn.setStream(sess, streamID)
+	code := sess.openStream(streamID, addr, func(proto.ReplyCode) {})
+	if code != proto.REPLY_SUCCEEDED {
+		sess.delStream(streamID)
+		return nil, code
+	}
+	f.targets[key] = t
+	return t, proto.REPLY_SUCCEEDED
+}
+
+//forward send the request in origin-form to its origin, false if the proxy connection should end
+func (f *httpForwarder) forward(req *http.Request, addr *proto.SOCKS5Address, action routeAction, reader io.Reader) bool {
+	t, code := f.getTarget(addr, action)
+	if code != proto.REPLY_SUCCEEDED {
+		fmt.Fprint(f.conn, httpErrorResponse(code))
+		return false
+	}
+	f.setCurrent(t)
+
+	upgrade := isUpgradeRequest(req)
+	var upgradeHeader []string
+	if upgrade {
+		upgradeHeader = req.Header["Upgrade"]
+	}
+	removeHopHeaders(req.Header)
+	if upgrade {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header["Upgrade"] = upgradeHeader
+	}
+	//keep a missing User-Agent missing instead of getting the go default
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "")
+	}
+
+	err := req.Write(t.writer())
+	if err != nil {
+		return false
+	}
+
+	//after a protocol upgrade the connection is no longer http
+	if upgrade {
+		if t.direct != nil {
+			io.Copy(t.direct, reader)
+		} else {
+			t.sess.forward(t.streamID, reader)
+		}
+		return false
+	}
+	return true
+}
+
+func (f *httpForwarder) close() {
+	for _, t := range f.targets {
+		if t.direct != nil {
+			t.direct.Close()
+			continue
+		}
+		if t.isOpen() {
+			t.sess.writeServerStreamDel(t.streamID)
+		}
+		t.sess.delStream(t.streamID)
+	}
+}
+
+func isUpgradeRequest(req *http.Request) bool {
+	for _, v := range req.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "Upgrade") {
+				return req.Header.Get("Upgrade") != ""
+			}
 		}
 	}
+	return false
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				header.Del(token)
+			}
+		}
+	}
+	for _, v := range hopHeaders {
+		header.Del(v)
+	}
 }
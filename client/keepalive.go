@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ptrbug/invis/metrics"
+	"github.com/ptrbug/invis/proto"
+)
+
+const (
+	defaultPingInterval   = time.Second * 15
+	defaultMaxMissedPongs = 3
+)
+
+var (
+	serverRTT         = metrics.NewGaugeVec("invis_server_rtt_seconds", "Latest round trip time to a server, from pings and probes.", "server")
+	keepaliveTimeouts = metrics.NewCounterVec("invis_keepalive_timeouts_total", "Sessions closed because pongs were missed.", "server")
+)
+
+//keepaliveConfig a session sends a ping every interval and is closed once
+//maxMissed pings are not answered, interval 0 disables pings
+type keepaliveConfig struct {
+	interval  time.Duration
+	maxMissed int
+}
+
+func newKeepaliveConfig(intervalSeconds, maxMissed int) keepaliveConfig {
+	cfg := keepaliveConfig{interval: time.Duration(intervalSeconds) * time.Second, maxMissed: maxMissed}
+	if intervalSeconds == 0 {
+		cfg.interval = defaultPingInterval
+	} else if intervalSeconds < 0 {
+		cfg.interval = 0
+	}
+	if cfg.maxMissed <= 0 {
+		cfg.maxMissed = defaultMaxMissedPongs
+	}
+	return cfg
+}
+
+var errPongTimeout = errors.New("pong timeout")
+
+//sessionPings the pings of a session that were not answered yet
+type sessionPings struct {
+	mutex   sync.Mutex
+	seq     uint64
+	sent    map[uint64]time.Time
+	missed  int
+	writing bool
+	rtt     time.Duration
+}
+
+func (sess *session) getRTT() time.Duration {
+	sess.pings.mutex.Lock()
+	defer sess.pings.mutex.Unlock()
+	return sess.pings.rtt
+}
+
+func (sess *session) writeServerPing(seq uint64) error {
+	var buffer [proto.HeadLength + proto.PingLength]byte
+	head := proto.MessageHead{}
+	head.StreamType = proto.STREAM_PING
+	head.ProtoType = proto.TCP_PROTO
+	head.StreamID = 0
+	head.BodyLength = proto.PingLength
+	head.Encode(buffer[:])
+	binary.BigEndian.PutUint64(buffer[proto.HeadLength:], seq)
+	return sess.writeServer(buffer[:])
+}
+
+//pong called by the agent
+func (sess *session) pong(body []byte) {
+	if len(body) < proto.PingLength {
+		return
+	}
+	seq := binary.BigEndian.Uint64(body)
+	pings := &sess.pings
+	pings.mutex.Lock()
+	tmSent, ok := pings.sent[seq]
+	rtt := time.Since(tmSent)
+	if ok {
+		//an answer proves the older pings were only slow
+		pings.sent = make(map[uint64]time.Time)
+		pings.missed = 0
+		pings.rtt = rtt
+	}
+	pings.mutex.Unlock()
+	if ok {
+		serverRTT.With(sess.name).Set(rtt.Seconds())
+	}
+}
+
+//keepalive ping the server until the session is closed, a session that does
+//not answer is closed, so the pool stops handing out its streams. Nothing is
+//sent before the server agreed to FEATURE_PING.
+func (sess *session) keepalive(p *sessionPool, cfg keepaliveConfig) {
+	if cfg.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+	pings := &sess.pings
+	for {
+		select {
+		case <-ticker.C:
+		case <-sess.die:
+			return
+		}
+		if !sess.getSettings().Has(proto.FEATURE_PING) {
+			continue
+		}
+
+		pings.mutex.Lock()
+		if pings.sent == nil {
+			pings.sent = make(map[uint64]time.Time)
+		}
+		//a ping not answered within an interval is missed
+		if len(pings.sent) > 0 {
+			pings.missed++
+		}
+		missed := pings.missed
+		rtt := pings.rtt
+		if missed >= cfg.maxMissed {
+			pings.mutex.Unlock()
+			keepaliveTimeouts.With(sess.name).Inc()
+			reportError("server %v session %v missed %v pongs, closed", sess.name, sess.id, missed)
+			p.setHealthy(false, errPongTimeout)
+			sess.server.Close()
+			return
+		}
+		//a write blocked on a dead connection is not repeated, the missed pongs close it
+		if pings.writing {
+			pings.mutex.Unlock()
+			continue
+		}
+		pings.seq++
+		seq := pings.seq
+		pings.sent[seq] = time.Now()
+		pings.writing = true
+		pings.mutex.Unlock()
+
+		if rtt > 0 {
+			p.setRTT(rtt)
+		}
+
+		go func() {
+			sess.writeServerPing(seq)
+			pings.mutex.Lock()
+			pings.writing = false
+			pings.mutex.Unlock()
+		}()
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/ptrbug/invis/metrics"
+)
+
+var (
+	sessionsActive     = metrics.NewGauge("invis_sessions_active", "Active tunnel sessions.")
+	streamsActive      = metrics.NewGauge("invis_streams_active", "Active tunnel streams.")
+	sessionConnects    = metrics.NewCounterVec("invis_session_connects_total", "Session pool connects to a server by result.", "server", "result")
+	tlsHandshakes      = metrics.NewCounterVec("invis_tls_handshakes_total", "Tunnel tls handshakes, connects and probes, by result.", "result")
+	streamOpenFailures = metrics.NewCounterVec("invis_stream_open_failures_total", "Streams that could not be opened by reason.", "reason")
+	tunnelBytes        = metrics.NewCounterVec("invis_bytes_total", "Tunnel bytes by direction.", "direction")
+	bytesUp            = tunnelBytes.With("up")
+	bytesDown          = tunnelBytes.With("down")
+)
+
+//runMetricsServ serve /metrics on a loopback address
+func runMetricsServ(addr string) error {
+	ln, err := listenLocal(addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	go http.Serve(ln, mux)
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"strings"
+)
+
+//a minimal reader of the MaxMind DB format, enough to look up the country of an ip
+//https://maxmind.github.io/MaxMind-DB/
+
+var mmdbMetadataStart = []byte("\xAB\xCD\xEFMaxMind.com")
+
+//mmdbDataSectionSeparator zero bytes between the search tree and the data section
+const mmdbDataSectionSeparator = 16
+
+//data field types
+const (
+	mmdbExtended  = 0
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+//mmdbMaxDepth limit the nesting of maps and arrays of a corrupt file
+const mmdbMaxDepth = 32
+
+var errMMDBInvalid = errors.New("invalid maxmind db")
+
+type mmdbReader struct {
+	tree          []byte
+	data          []byte
+	nodeCount     uint
+	recordSize    uint
+	ipVersion     uint
+	ipv4StartNode uint
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	index := bytes.LastIndex(buf, mmdbMetadataStart)
+	if index == -1 {
+		return nil, errMMDBInvalid
+	}
+	metadataStart := index + len(mmdbMetadataStart)
+	d := &mmdbDecoder{buf: buf[metadataStart:]}
+	value, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errMMDBInvalid
+	}
+
+	r := &mmdbReader{}
+	r.nodeCount = mmdbUint(metadata["node_count"])
+	r.recordSize = mmdbUint(metadata["record_size"])
+	r.ipVersion = mmdbUint(metadata["ip_version"])
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, errMMDBInvalid
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+mmdbDataSectionSeparator > uint(index) {
+		return nil, errMMDBInvalid
+	}
+	r.tree = buf[:treeSize]
+	r.data = buf[treeSize+mmdbDataSectionSeparator : index]
+
+	//ipv4 addresses of an ipv6 tree are stored under ::/96
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4StartNode = node
+	}
+	return r, nil
+}
+
+func mmdbUint(v interface{}) uint {
+	switch n := v.(type) {
+	case uint64:
+		return uint(n)
+	}
+	return 0
+}
+
+func (r *mmdbReader) readNode(node uint, bit uint) uint {
+	recordBytes := r.recordSize / 4
+	b := r.tree[node*recordBytes : (node+1)*recordBytes]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+//lookup the record of ip, nil if the ip is not in the database
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4StartNode
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := uint(0); i < uint(len(ip))*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-i%8)) & 1
+		node = r.readNode(node, bit)
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, errMMDBInvalid
+	}
+	offset := node - r.nodeCount - mmdbDataSectionSeparator
+	d := &mmdbDecoder{buf: r.data}
+	value, _, err := d.decode(offset, 0)
+	return value, err
+}
+
+//country the lower case iso code of the country of ip
+func (r *mmdbReader) country(ip net.IP) string {
+	record, err := r.lookup(ip)
+	if err != nil {
+		return ""
+	}
+	for _, key := range []string{"country", "registered_country"} {
+		if code := mmdbPath(record, key, "iso_code"); code != "" {
+			return strings.ToLower(code)
+		}
+	}
+	return ""
+}
+
+func mmdbPath(value interface{}, keys ...string) string {
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = m[key]
+	}
+	s, _ := value.(string)
+	return s
+}
+
+type mmdbDecoder struct {
+	buf []byte
+}
+
+func (d *mmdbDecoder) bytes(offset uint, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.buf)) || offset+size < offset {
+		return nil, errMMDBInvalid
+	}
+	return d.buf[offset : offset+size], nil
+}
+
+func (d *mmdbDecoder) uint(offset uint, size uint) (uint64, error) {
+	b, err := d.bytes(offset, size)
+	if err != nil || size > 8 {
+		return 0, errMMDBInvalid
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+//decode the field at offset, returns the value and the offset of the next field
+func (d *mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errMMDBInvalid
+	}
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	typeNum := uint(ctrl >> 5)
+
+	if typeNum == mmdbPointer {
+		size := uint((ctrl>>3)&0x3) + 1
+		v, err := d.uint(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		prefix := uint64(ctrl & 0x7)
+		var pointer uint64
+		switch size {
+		case 1:
+			pointer = prefix<<8 | v
+		case 2:
+			pointer = (prefix<<16 | v) + 2048
+		case 3:
+			pointer = (prefix<<24 | v) + 526336
+		default:
+			pointer = v
+		}
+		value, _, err := d.decode(uint(pointer), depth+1)
+		return value, offset + size, err
+	}
+
+	if typeNum == mmdbExtended {
+		b, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typeNum = 7 + uint(b[0])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		v, err := d.uint(offset, extra)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + uint(v)
+		case 2:
+			size = 285 + uint(v)
+		default:
+			size = 65821 + uint(v)
+		}
+	}
+
+	switch typeNum {
+	case mmdbString, mmdbBytes:
+		b, err := d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if typeNum == mmdbString {
+			return string(b), offset + size, nil
+		}
+		return b, offset + size, nil
+	case mmdbDouble:
+		v, err := d.uint(offset, 8)
+		return math.Float64frombits(v), offset + 8, err
+	case mmdbFloat:
+		v, err := d.uint(offset, 4)
+		return float64(math.Float32frombits(uint32(v))), offset + 4, err
+	case mmdbUint16, mmdbUint32, mmdbInt32, mmdbUint64:
+		v, err := d.uint(offset, size)
+		return v, offset + size, err
+	case mmdbUint128:
+		b, err := d.bytes(offset, size)
+		return b, offset + size, err
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbMap:
+		m := make(map[string]interface{})
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errMMDBInvalid
+			}
+			m[k] = value
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		var a []interface{}
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	}
+	return nil, 0, errMMDBInvalid
+}
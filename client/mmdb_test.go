@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func mmdbTestString(s string) []byte {
+	return append([]byte{mmdbString<<5 | byte(len(s))}, s...)
+}
+
+func mmdbTestUint(n uint32) []byte {
+	b := []byte{mmdbUint32<<5 | 4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], n)
+	return b
+}
+
+//mmdbTestMap keys and values alternate, values already encoded
+func mmdbTestMap(fields ...[]byte) []byte {
+	out := []byte{mmdbMap<<5 | byte(len(fields)/2)}
+	for _, f := range fields {
+		out = append(out, f...)
+	}
+	return out
+}
+
+type mmdbTestNode struct {
+	child [2]*mmdbTestNode
+	data  [2]int
+	index int
+}
+
+//buildTestMMDB an ipv6 database with 24 bit records mapping the networks to countries,
+//ipv4 networks are stored under ::/96
+func buildTestMMDB(t *testing.T, countries map[string]string) []byte {
+	var data []byte
+	root := &mmdbTestNode{data: [2]int{-1, -1}}
+	for cidr, country := range countries {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := ipNet.IP.To16()
+		ones, _ := ipNet.Mask.Size()
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			ip = append(make(net.IP, 12), ip4...)
+			ones += 96
+		}
+		node := root
+		for i := 0; i < ones-1; i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if node.child[bit] == nil {
+				node.child[bit] = &mmdbTestNode{data: [2]int{-1, -1}}
+			}
+			node = node.child[bit]
+		}
+		node.data[ip[(ones-1)/8]>>(7-(ones-1)%8)&1] = len(data)
+		data = append(data, mmdbTestMap(mmdbTestString("country"),
+			mmdbTestMap(mmdbTestString("iso_code"), mmdbTestString(country)))...)
+	}
+
+	nodes := []*mmdbTestNode{root}
+	for i := 0; i < len(nodes); i++ {
+		for _, c := range nodes[i].child {
+			if c != nil {
+				c.index = len(nodes)
+				nodes = append(nodes, c)
+			}
+		}
+	}
+	count := len(nodes)
+	var tree []byte
+	for _, node := range nodes {
+		for bit := 0; bit < 2; bit++ {
+			record := count
+			if node.child[bit] != nil {
+				record = node.child[bit].index
+			} else if node.data[bit] >= 0 {
+				record = count + mmdbDataSectionSeparator + node.data[bit]
+			}
+			tree = append(tree, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(tree)
+	buf.Write(make([]byte, mmdbDataSectionSeparator))
+	buf.Write(data)
+	buf.Write(mmdbMetadataStart)
+	buf.Write(mmdbTestMap(mmdbTestString("node_count"), mmdbTestUint(uint32(count)),
+		mmdbTestString("record_size"), mmdbTestUint(24),
+		mmdbTestString("ip_version"), mmdbTestUint(6)))
+	return buf.Bytes()
+}
+
+var mmdbTestCountries = map[string]string{
+	"1.2.3.0/24":    "CN",
+	"8.8.8.0/24":    "US",
+	"2001:db8::/32": "JP",
+}
+
+func TestMMDBCountry(t *testing.T) {
+	r, err := newMMDBReader(buildTestMMDB(t, mmdbTestCountries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		country string
+	}{
+		{"1.2.3.4", "cn"},
+		{"1.2.3.255", "cn"},
+		{"1.2.4.1", ""},
+		{"8.8.8.8", "us"},
+		{"9.9.9.9", ""},
+		{"2001:db8::1", "jp"},
+		{"2001:db9::1", ""},
+		{"::ffff:8.8.8.8", "us"},
+	}
+	for _, tt := range tests {
+		if got := r.country(net.ParseIP(tt.ip)); got != tt.country {
+			t.Errorf("country(%v) = %q, want %q", tt.ip, got, tt.country)
+		}
+	}
+}
+
+func TestMMDBInvalid(t *testing.T) {
+	valid := buildTestMMDB(t, mmdbTestCountries)
+	metadata := bytes.LastIndex(valid, mmdbMetadataStart)
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"empty", nil},
+		{"no metadata", valid[:metadata]},
+		{"truncated metadata", valid[:metadata+len(mmdbMetadataStart)+3]},
+		{"truncated tree", append(append([]byte{}, valid[:10]...), valid[metadata:]...)},
+		{"bad record size", bytes.Replace(valid, append(mmdbTestString("record_size"), mmdbTestUint(24)...),
+			append(mmdbTestString("record_size"), mmdbTestUint(20)...), 1)},
+	}
+	for _, tt := range tests {
+		if _, err := newMMDBReader(tt.buf); err == nil {
+			t.Errorf("%v: accepted", tt.name)
+		}
+	}
+}
+
+//a corrupt data section fails the lookup without panicking
+func TestMMDBCorruptData(t *testing.T) {
+	buf := buildTestMMDB(t, map[string]string{"1.2.3.0/24": "CN"})
+	r, err := newMMDBReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated", r.data[:len(r.data)-2]},
+		{"string past the end", []byte{mmdbString<<5 | 20, 'a'}},
+		{"unknown type", []byte{mmdbExtended << 5, 200}},
+		{"pointer loop", []byte{mmdbPointer << 5, 0}},
+		{"map with int key", mmdbTestMap(mmdbTestUint(1), mmdbTestString("x"))},
+	}
+	ip := net.ParseIP("1.2.3.4")
+	for _, tt := range tests {
+		r.data = tt.data
+		if _, err := r.lookup(ip); err == nil {
+			t.Errorf("%v: no error", tt.name)
+		}
+		if got := r.country(ip); got != "" {
+			t.Errorf("%v: country %q", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ptrbug/invis/proto"
+)
+
+type routeAction string
+
+//route actions
+const (
+	routeProxy  routeAction = "proxy"
+	routeDirect routeAction = "direct"
+	routeBlock  routeAction = "block"
+)
+
+//routing modes, rule routes by the rules, global proxies and direct connects everything
+const (
+	routeModeRule   = "rule"
+	routeModeGlobal = "global"
+	routeModeDirect = "direct"
+)
+
+//rule types
+const (
+	ruleDomain        = "domain"
+	ruleDomainSuffix  = "domain-suffix"
+	ruleDomainKeyword = "domain-keyword"
+	ruleDomainRegex   = "domain-regex"
+	ruleIPCIDR        = "ip-cidr"
+	rulePort          = "port"
+	ruleGeoIP         = "geoip"
+	ruleGeoSite       = "geosite"
+)
+
+type ruleConfig struct {
+	Type   string
+	Value  string
+	Action routeAction
+}
+
+type routingConfig struct {
+	Mode          string
+	Default       routeAction
+	ResolveDomain bool
+	Rules         []ruleConfig
+	GeoIPFile     string
+	GeoIPDir      string
+	GeoSiteDir    string
+}
+
+//routeTarget the destination a rule is matched against
+type routeTarget struct {
+	domain string
+	ips    []net.IP
+	port   uint16
+}
+
+type routeRule struct {
+	ruleConfig
+	matchIP bool
+	match   func(target *routeTarget) bool
+}
+
+type router struct {
+	mode          atomic.Value
+	defaultAction routeAction
+	resolveDomain bool
+	rules         []*routeRule
+}
+
+func parseRouteAction(action routeAction, defaultAction routeAction) (routeAction, error) {
+	switch action {
+	case "":
+		return defaultAction, nil
+	case routeProxy, routeDirect, routeBlock:
+		return action, nil
+	}
+	return "", fmt.Errorf("unknown route action:%v", action)
+}
+
+func newRouter(cfg routingConfig) (*router, error) {
+	defaultAction, err := parseRouteAction(cfg.Default, routeProxy)
+	if err != nil {
+		return nil, err
+	}
+	r := &router{defaultAction: defaultAction, resolveDomain: cfg.ResolveDomain}
+	if cfg.Mode == "" {
+		cfg.Mode = routeModeRule
+	}
+	if err := r.setMode(cfg.Mode); err != nil {
+		return nil, err
+	}
+	files := newRuleFiles()
+	for _, v := range cfg.Rules {
+		rule, err := newRouteRule(v, &cfg, files)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s %s: %v", v.Type, v.Value, err)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	if len(files.files) > 0 {
+		go files.checkUpdateOnTimer()
+	}
+	return r, nil
+}
+
+func (r *router) getMode() string {
+	return r.mode.Load().(string)
+}
+
+func (r *router) setMode(mode string) error {
+	switch mode {
+	case routeModeRule, routeModeGlobal, routeModeDirect:
+		r.mode.Store(mode)
+		return nil
+	}
+	return fmt.Errorf("unknown routing mode:%v", mode)
+}
+
+func newRouteRule(cfg ruleConfig, routingCfg *routingConfig, files *ruleFiles) (*routeRule, error) {
+	action, err := parseRouteAction(cfg.Action, routeProxy)
+	if err != nil {
+		return nil, err
+	}
+	rule := &routeRule{ruleConfig: cfg}
+	rule.Action = action
+	value := strings.ToLower(cfg.Value)
+
+	switch cfg.Type {
+	case ruleDomain:
+		rule.match = func(target *routeTarget) bool {
+			return target.domain == value
+		}
+	case ruleDomainSuffix:
+		value = strings.TrimPrefix(value, ".")
+		rule.match = func(target *routeTarget) bool {
+			return target.domain == value || strings.HasSuffix(target.domain, "."+value)
+		}
+	case ruleDomainKeyword:
+		rule.match = func(target *routeTarget) bool {
+			return target.domain != "" && strings.Contains(target.domain, value)
+		}
+	case ruleDomainRegex:
+		re, err := regexp.Compile(cfg.Value)
+		if err != nil {
+			return nil, err
+		}
+		rule.match = func(target *routeTarget) bool {
+			return target.domain != "" && re.MatchString(target.domain)
+		}
+	case ruleIPCIDR:
+		_, ipNet, err := net.ParseCIDR(cfg.Value)
+		if err != nil {
+			return nil, err
+		}
+		rule.matchIP = true
+		rule.match = func(target *routeTarget) bool {
+			for _, ip := range target.ips {
+				if ipNet.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}
+	case rulePort:
+		low, high, err := proto.ParsePortRange(cfg.Value)
+		if err != nil {
+			return nil, err
+		}
+		rule.match = func(target *routeTarget) bool {
+			return target.port >= low && target.port <= high
+		}
+	case ruleGeoIP:
+		match, err := newGeoIPMatcher(routingCfg, files, cfg.Value)
+		if err != nil {
+			return nil, err
+		}
+		rule.matchIP = true
+		rule.match = func(target *routeTarget) bool {
+			for _, ip := range target.ips {
+				if match(ip) {
+					return true
+				}
+			}
+			return false
+		}
+	case ruleGeoSite:
+		match, err := newGeoSiteMatcher(routingCfg, files, cfg.Value)
+		if err != nil {
+			return nil, err
+		}
+		rule.match = func(target *routeTarget) bool {
+			return target.domain != "" && match(target.domain)
+		}
+	default:
+		return nil, fmt.Errorf("unknown rule type:%v", cfg.Type)
+	}
+	return rule, nil
+}
+
+//route choose how to reach addr, the first matched rule wins
+func (r *router) route(addr *proto.SOCKS5Address) routeAction {
+	switch r.getMode() {
+	case routeModeGlobal:
+		return routeProxy
+	case routeModeDirect:
+		return routeDirect
+	}
+
+	target := &routeTarget{port: addr.Port}
+	resolved := true
+	if addr.AddressType == proto.DOMAINNAME {
+		if ip := net.ParseIP(addr.FQDN); ip != nil {
+			target.ips = []net.IP{ip}
+		} else {
+			target.domain = strings.ToLower(strings.TrimSuffix(addr.FQDN, "."))
+			resolved = !r.resolveDomain
+		}
+	} else {
+		target.ips = []net.IP{addr.IP}
+	}
+
+	for _, rule := range r.rules {
+		if rule.matchIP && !resolved {
+			resolved = true
+			target.ips, _ = net.LookupIP(target.domain)
+		}
+		if rule.match(target) {
+			loger.Printf("route %v match %s %s, %s\n", addr, rule.Type, rule.Value, rule.Action)
+			return rule.Action
+		}
+	}
+	return r.defaultAction
+}
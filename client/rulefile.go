@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+//ruleFileCheckInterval how often rule set files are checked for changes
+const ruleFileCheckInterval = time.Second * 10
+
+//ruleFile a rule set loaded from a local file, parsed again when the file changes
+type ruleFile struct {
+	path  string
+	parse func(data []byte) (interface{}, error)
+
+	mutex   sync.RWMutex
+	modTime time.Time
+	size    int64
+	value   interface{}
+}
+
+func (f *ruleFile) get() interface{} {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.value
+}
+
+//load parse the file if it changed since the last load, a bad file keeps the old rule set
+func (f *ruleFile) load() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	f.mutex.RLock()
+	changed := !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+	f.mutex.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	value, err := f.parse(data)
+	if err != nil {
+		return false, err
+	}
+
+	f.mutex.Lock()
+	f.value = value
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.mutex.Unlock()
+	return true, nil
+}
+
+//ruleFiles the rule set files used by the router, each file is loaded once
+type ruleFiles struct {
+	mutex sync.Mutex
+	files map[string]*ruleFile
+}
+
+func newRuleFiles() *ruleFiles {
+	return &ruleFiles{files: make(map[string]*ruleFile)}
+}
+
+func (r *ruleFiles) open(path string, parse func(data []byte) (interface{}, error)) (*ruleFile, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f, ok := r.files[path]
+	if ok {
+		return f, nil
+	}
+	f = &ruleFile{path: path, parse: parse}
+	if _, err := f.load(); err != nil {
+		return nil, err
+	}
+	loger.Printf("rule set %v loaded\n", path)
+	r.files[path] = f
+	return f, nil
+}
+
+func (r *ruleFiles) checkUpdateOnTimer() {
+	for {
+		select {
+		case <-time.After(ruleFileCheckInterval):
+			r.mutex.Lock()
+			files := make([]*ruleFile, 0, len(r.files))
+			for _, f := range r.files {
+				files = append(files, f)
+			}
+			r.mutex.Unlock()
+
+			for _, f := range files {
+				reloaded, err := f.load()
+				if err != nil {
+					loger.Printf("rule set %v reload error:%v\n", f.path, err)
+				} else if reloaded {
+					loger.Printf("rule set %v reloaded\n", f.path)
+				}
+			}
+		}
+	}
+}
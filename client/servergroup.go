@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type selectPolicy string
+
+//server select policies
+const (
+	selectLowestRTT  selectPolicy = "lowest-rtt"
+	selectRoundRobin selectPolicy = "round-robin"
+	selectFallback   selectPolicy = "fallback"
+)
+
+const defaultProbeInterval = time.Second * 60
+
+//serverGroup choose a server for every new stream, servers that can not be
+//reached are only tried after all the healthy ones failed
+type serverGroup struct {
+	pools         []*sessionPool
+	policy        selectPolicy
+	probeInterval time.Duration
+	next          uint32
+
+	mutex  sync.Mutex
+	active *sessionPool
+}
+
+func newServerGroup(pools []*sessionPool, policy selectPolicy, probeInterval time.Duration) (*serverGroup, error) {
+	switch policy {
+	case "":
+		policy = selectFallback
+	case selectLowestRTT, selectRoundRobin, selectFallback:
+	default:
+		return nil, fmt.Errorf("unknown select policy:%v", policy)
+	}
+	if probeInterval <= 0 {
+		probeInterval = defaultProbeInterval
+	}
+	return &serverGroup{pools: pools, policy: policy, probeInterval: probeInterval}, nil
+}
+
+func (g *serverGroup) find(name string) *sessionPool {
+	for _, p := range g.pools {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+//getActive the server chosen at runtime, nil if the servers are selected by the policy
+func (g *serverGroup) getActive() *sessionPool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.active
+}
+
+//setActive only use the named server, an empty name goes back to the policy
+func (g *serverGroup) setActive(name string) error {
+	var active *sessionPool
+	if name != "" {
+		active = g.find(name)
+		if active == nil {
+			return fmt.Errorf("unknown server:%v", name)
+		}
+	}
+	g.mutex.Lock()
+	g.active = active
+	g.mutex.Unlock()
+	return nil
+}
+
+//candidates the servers in the order they should be tried
+func (g *serverGroup) candidates() []*sessionPool {
+	if active := g.getActive(); active != nil {
+		return []*sessionPool{active}
+	}
+	pools := make([]*sessionPool, 0, len(g.pools))
+	switch g.policy {
+	case selectRoundRobin:
+		n := int(atomic.AddUint32(&g.next, 1) % uint32(len(g.pools)))
+		pools = append(pools, g.pools[n:]...)
+		pools = append(pools, g.pools[:n]...)
+	case selectLowestRTT:
+		pools = append(pools, g.pools...)
+		rtts := make(map[*sessionPool]time.Duration, len(pools))
+		for _, p := range pools {
+			rtts[p] = p.getRTT()
+		}
+		sort.SliceStable(pools, func(i, j int) bool {
+			a, b := rtts[pools[i]], rtts[pools[j]]
+			return a != 0 && (b == 0 || a < b)
+		})
+	default:
+		pools = append(pools, g.pools...)
+	}
+
+	healthy := make(map[*sessionPool]bool, len(pools))
+	for _, p := range pools {
+		healthy[p] = p.healthy()
+	}
+	sort.SliceStable(pools, func(i, j int) bool {
+		return healthy[pools[i]] && !healthy[pools[j]]
+	})
+	return pools
+}
+
+func (g *serverGroup) getSessonAndStream(conn io.WriteCloser) (sess *session, streamID uint16) {
+	for _, p := range g.candidates() {
+		sess, streamID = p.getSessonAndStream(conn)
+		if sess != nil {
+			return sess, streamID
+		}
+	}
+	streamOpenFailures.With("no_session").Inc()
+	reportError("no server available for a new stream")
+	return nil, 0
+}
+
+func (g *serverGroup) probe() {
+	var wg sync.WaitGroup
+	for _, p := range g.pools {
+		wg.Add(1)
+		go func(p *sessionPool) {
+			defer wg.Done()
+			p.probe()
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (g *serverGroup) run() {
+	for _, p := range g.pools {
+		p.run()
+	}
+
+	if len(g.pools) < 2 {
+		return
+	}
+	go func() {
+		g.probe()
+		for {
+			select {
+			case <-time.After(g.probeInterval):
+				g.probe()
+			}
+		}
+	}()
+}
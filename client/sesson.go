@@ -6,23 +6,179 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ptrbug/invis/proto"
 )
 
+var sessionSeq uint64
+
+//streamReplyTimeout how long to wait for the server to report a STREAM_NEW,
+//longer than the server spends dialing all addresses of a destination
+const streamReplyTimeout = time.Second * 30
+
+//udpSettingsTimeout how long a udp associate waits for the settings of the server
+const udpSettingsTimeout = time.Second * 5
+
+//clientSettings what this client supports, FEATURE_PADDING is added when Shaping is configured
+var clientSettings = proto.Settings{Version: proto.ProtocolVersion,
+	Features: proto.FEATURE_STREAM_REPLY | proto.FEATURE_FLOW_CONTROL | proto.FEATURE_HALF_CLOSE |
+		proto.FEATURE_UDP | proto.FEATURE_PING}
+
+//pendingStream a stream waiting for the STREAM_REPLY of the server
+type pendingStream struct {
+	reply func(code proto.ReplyCode)
+	done  chan proto.ReplyCode
+}
+
 //Session nop
 type session struct {
-	curStreamID uint32
+	curStreamID uint16
+	id          uint64
+	name        string
 	server      net.Conn
 
 	mutex       sync.Mutex
-	clients     map[uint16]net.Conn
+	clients     map[uint16]io.WriteCloser
+	pending     map[uint16]*pendingStream
+	flows       map[uint16]*streamFlow
+	shapers     map[uint16]*proto.Shaper
 	isAutoClose bool
 	isClosed    bool
+	local       proto.Settings
+	settings    proto.Settings
+	//settingsCh closed when the settings of the server arrived
+	settingsCh chan struct{}
+
+	pings sessionPings
+	die   chan struct{}
+}
+
+//newSession a session speaking the legacy protocol until the settings of the server arrive
+func newSession(server net.Conn, name string) *session {
+	sessionsActive.Inc()
+	return &session{id: atomic.AddUint64(&sessionSeq, 1),
+		name:       name,
+		server:     server,
+		clients:    make(map[uint16]io.WriteCloser, 16),
+		pending:    make(map[uint16]*pendingStream),
+		flows:      make(map[uint16]*streamFlow),
+		shapers:    make(map[uint16]*proto.Shaper),
+		settingsCh: make(chan struct{}),
+		die:        make(chan struct{})}
+}
+
+//sendSettings send the settings of the client without waiting for the answer,
+//servers without settings never answer and the session stays legacy
+func (sess *session) sendSettings() error {
+	local := clientSettings
+	if config.Shaping != nil {
+		local.Features |= proto.FEATURE_PADDING
+	}
+	sess.mutex.Lock()
+	sess.local = local
+	sess.mutex.Unlock()
+	return sess.writeServer(local.Encode())
+}
+
+//applySettings called by the agent, streams opened from now on use the
+//features both sides support, the open ones keep what they started with
+func (sess *session) applySettings(settings proto.Settings) {
+	sess.mutex.Lock()
+	sess.settings = sess.local.Negotiate(settings)
+	sess.mutex.Unlock()
+	select {
+	case <-sess.settingsCh:
+	default:
+		close(sess.settingsCh)
+	}
+}
+
+//getSettings the negotiated settings, version 0 until the server answered
+func (sess *session) getSettings() proto.Settings {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+	return sess.settings
+}
+
+//addShaper the shaper of a new stream, writing frames unchanged if padding was not negotiated
+func (sess *session) addShaper(streamID uint16, datagram bool) {
+	var policy *proto.ShapingPolicy
+	if sess.getSettings().Has(proto.FEATURE_PADDING) {
+		policy = config.Shaping
+	}
+	shaper := proto.NewShaper(policy, sess.writeServer)
+	if datagram {
+		shaper = proto.NewDatagramShaper(policy, sess.writeServer)
+	}
+	sess.mutex.Lock()
+	if _, ok := sess.clients[streamID]; ok {
+		sess.shapers[streamID] = shaper
+	}
+	sess.mutex.Unlock()
 }
 
-func newSession(server net.Conn) *session {
-	return &session{server: server, clients: make(map[uint16]net.Conn, 16)}
+//getShaper all STREAM_DATA of a stream is written with its shaper
+func (sess *session) getShaper(streamID uint16) *proto.Shaper {
+	sess.mutex.Lock()
+	shaper, ok := sess.shapers[streamID]
+	sess.mutex.Unlock()
+	if !ok {
+		return proto.NewShaper(nil, sess.writeServer)
+	}
+	return shaper
+}
+
+//flushShaper what the shaper of a stream held back goes out before the stream ends
+func (sess *session) flushShaper(streamID uint16) {
+	sess.mutex.Lock()
+	shaper, ok := sess.shapers[streamID]
+	sess.mutex.Unlock()
+	if ok {
+		shaper.Flush()
+	}
+}
+
+//supportsUDP only servers announcing FEATURE_UDP relay udp, servers without
+//settings close the session on a udp stream. Waits for the settings if they
+//were sent and the answer did not arrive yet.
+func (sess *session) supportsUDP() bool {
+	sess.mutex.Lock()
+	sent := sess.local.Version != 0
+	sess.mutex.Unlock()
+	if !sent {
+		return false
+	}
+	select {
+	case <-sess.settingsCh:
+	case <-sess.die:
+		return false
+	case <-time.After(udpSettingsTimeout):
+		return false
+	}
+	return sess.getSettings().Has(proto.FEATURE_UDP)
+}
+
+//streamNewFlags the STREAM_NEW flags of a stream, 0 for the legacy protocol
+//which has no flags byte
+func streamNewFlags(settings proto.Settings, tcp bool) byte {
+	if !settings.Has(proto.FEATURE_STREAM_REPLY) {
+		return 0
+	}
+	flags := proto.STREAM_NEW_WANT_REPLY
+	if tcp && settings.Has(proto.FEATURE_FLOW_CONTROL) {
+		flags |= proto.STREAM_NEW_FLOW_CONTROL
+		if settings.Has(proto.FEATURE_HALF_CLOSE) {
+			flags |= proto.STREAM_NEW_HALF_CLOSE
+		}
+	}
+	return flags
+}
+
+func (sess *session) streamCount() int {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+	return len(sess.clients)
 }
 
 func (sess *session) autoClose() {
@@ -34,36 +190,153 @@ func (sess *session) autoClose() {
 	sess.mutex.Unlock()
 }
 
-func (sess *session) newStream(conn net.Conn) (uint16, bool) {
-	streamID := uint16(atomic.AddUint32(&sess.curStreamID, 1))
+//newStream take the next free id, ids wrap around and skip the streams still
+//open, so a session carries any number of streams. False if the session is
+//closed or all ids are in use.
+func (sess *session) newStream(conn io.WriteCloser) (uint16, bool) {
 	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
 	if sess.isClosed {
-		sess.mutex.Unlock()
 		return 0, false
 	}
-	sess.clients[streamID] = conn
-	sess.mutex.Unlock()
-	return streamID, true
+	for i := 0; i < 1<<16; i++ {
+		sess.curStreamID++
+		streamID := sess.curStreamID
+		//StreamID 0 carries the settings
+		if streamID == 0 {
+			continue
+		}
+		if _, ok := sess.clients[streamID]; ok {
+			continue
+		}
+		sess.clients[streamID] = conn
+		streamsActive.Inc()
+		return streamID, true
+	}
+	return 0, false
 }
 
 func (sess *session) delStream(streamID uint16) {
 	sess.mutex.Lock()
-	delete(sess.clients, streamID)
+	if _, ok := sess.clients[streamID]; ok {
+		delete(sess.clients, streamID)
+		streamsActive.Dec()
+	}
+	if flow, ok := sess.flows[streamID]; ok {
+		delete(sess.flows, streamID)
+		flow.close()
+	}
+	if shaper, ok := sess.shapers[streamID]; ok {
+		delete(sess.shapers, streamID)
+		shaper.Stop()
+	}
 	if sess.isAutoClose == true && len(sess.clients) == 0 {
 		sess.server.Close()
 	}
 	sess.mutex.Unlock()
 }
 
+//remoteDelStream the server closed the stream, so close the local side too,
+//unless the stream never opened, then the waiter answers the application.
+//With flow control the connection is closed after the buffered data is written.
+func (sess *session) remoteDelStream(streamID uint16) {
+	sess.mutex.Lock()
+	conn, ok := sess.clients[streamID]
+	_, isPending := sess.pending[streamID]
+	_, hasFlow := sess.flows[streamID]
+	sess.mutex.Unlock()
+	if isPending {
+		sess.streamReplied(streamID, proto.REPLY_FAILURE)
+		return
+	}
+	if ok && !hasFlow {
+		conn.Close()
+	}
+	sess.delStream(streamID)
+}
+
+//streamReplied called by the agent, so reply writes to the application
+//before any data of the stream
+func (sess *session) streamReplied(streamID uint16, code proto.ReplyCode) {
+	sess.mutex.Lock()
+	p, ok := sess.pending[streamID]
+	delete(sess.pending, streamID)
+	sess.mutex.Unlock()
+	if !ok {
+		return
+	}
+	p.reply(code)
+	if code != proto.REPLY_SUCCEEDED {
+		sess.delStream(streamID)
+	}
+	p.done <- code
+}
+
+//openStream send STREAM_NEW, addr nil for a udp stream, and call reply with
+//the outcome before the stream is used. Without stream replies the server
+//is assumed to succeed.
+func (sess *session) openStream(streamID uint16, addr *proto.SOCKS5Address, reply func(code proto.ReplyCode)) proto.ReplyCode {
+	flags := streamNewFlags(sess.getSettings(), addr != nil)
+	sess.addShaper(streamID, addr == nil)
+	if flags&proto.STREAM_NEW_WANT_REPLY == 0 {
+		reply(proto.REPLY_SUCCEEDED)
+		if err := sess.writeServerStreamNew(addr, streamID, flags); err != nil {
+			return proto.REPLY_FAILURE
+		}
+		return proto.REPLY_SUCCEEDED
+	}
+
+	p := &pendingStream{reply: reply, done: make(chan proto.ReplyCode, 1)}
+	sess.mutex.Lock()
+	if sess.isClosed {
+		sess.mutex.Unlock()
+		reply(proto.REPLY_FAILURE)
+		return proto.REPLY_FAILURE
+	}
+	sess.pending[streamID] = p
+	sess.mutex.Unlock()
+	if flags&proto.STREAM_NEW_FLOW_CONTROL != 0 {
+		sess.newFlow(streamID, flags&proto.STREAM_NEW_HALF_CLOSE != 0)
+	}
+
+	err := sess.writeServerStreamNew(addr, streamID, flags)
+	if err == nil {
+		select {
+		case code := <-p.done:
+			return code
+		case <-time.After(streamReplyTimeout):
+		}
+	}
+
+	//the agent may be replying right now
+	sess.mutex.Lock()
+	_, isPending := sess.pending[streamID]
+	delete(sess.pending, streamID)
+	sess.mutex.Unlock()
+	if !isPending {
+		return <-p.done
+	}
+	if err != nil {
+		reply(proto.REPLY_FAILURE)
+		return proto.REPLY_FAILURE
+	}
+	reply(proto.REPLY_TIMEOUT)
+	sess.writeServerStreamDel(streamID)
+	return proto.REPLY_TIMEOUT
+}
+
 func (sess *session) writeServer(data []byte) error {
 	_, err := sess.server.Write(data)
 	if err != nil {
 		sess.server.Close()
+		return err
 	}
-	return err
+	bytesUp.Add(float64(len(data)))
+	return nil
 }
 
 func (sess *session) writeServerStreamDel(streamID uint16) error {
+	sess.flushShaper(streamID)
 	var buffer [proto.HeadLength]byte
 	head := proto.MessageHead{}
 	head.StreamType = proto.STREAM_DEL
@@ -74,31 +347,117 @@ func (sess *session) writeServerStreamDel(streamID uint16) error {
 	return sess.writeServer(buffer[:])
 }
 
-func (sess *session) writeServerStreamNew(addr *proto.SOCKS5Address, streamID uint16) error {
+//writeServerStreamNew addr nil opens a stream relaying the datagrams of a udp associate,
+//flags 0 leaves out the flags byte
+func (sess *session) writeServerStreamNew(addr *proto.SOCKS5Address, streamID uint16, flags byte) error {
 	data := make([]byte, proto.MaxMessageSize)
-	length, err := addr.Encode(data[proto.HeadLength:])
-	if err != nil {
-		return errors.New("SOCKS5Address encode error")
-	}
-
 	head := proto.MessageHead{}
 	head.StreamType = proto.STREAM_NEW
-	head.ProtoType = proto.TCP_PROTO
+	head.ProtoType = proto.UPD_PROTO
+	length := 0
+	if addr != nil {
+		var err error
+		length, err = addr.Encode(data[proto.HeadLength:])
+		if err != nil {
+			return errors.New("SOCKS5Address encode error")
+		}
+		head.ProtoType = proto.TCP_PROTO
+	}
+	if flags != 0 {
+		data[proto.HeadLength+length] = flags
+		length++
+	}
+
 	head.StreamID = streamID
 	head.BodyLength = uint16(length)
 	head.Encode(data[0:proto.HeadLength])
 	return sess.writeServer(data[0 : proto.HeadLength+int(head.BodyLength)])
 }
 
+//forward read from r and send to the server as STREAM_DATA until r fails,
+//with half close the end of r is sent as STREAM_FIN and forward returns
+//once the server direction ended too
+func (sess *session) forward(streamID uint16, r io.Reader) {
+	buffer := make([]byte, proto.MaxMessageSize)
+	flow := sess.getFlow(streamID)
+	shaper := sess.getShaper(streamID)
+
+	for {
+		n, err := r.Read(buffer[proto.HeadLength:])
+		if err == io.EOF && flow != nil && flow.halfClose {
+			if sess.writeServerStreamFin(streamID) == nil {
+				<-flow.recvDone
+			}
+			return
+		}
+		if err != nil {
+			sess.writeServerStreamDel(streamID)
+			return
+		}
+		if flow != nil && !flow.send.Take(n) {
+			return
+		}
+
+		head := proto.MessageHead{}
+		head.StreamType = proto.STREAM_DATA
+		head.ProtoType = proto.TCP_PROTO
+		head.StreamID = streamID
+		head.BodyLength = uint16(n)
+		head.Encode(buffer[0:proto.HeadLength])
+		err = shaper.Write(buffer[:proto.HeadLength+n])
+		if err != nil {
+			return
+		}
+	}
+}
+
+//streamWriter send everything written as STREAM_DATA of a stream
+type streamWriter struct {
+	sess     *session
+	streamID uint16
+}
+
+func (w *streamWriter) Write(data []byte) (int, error) {
+	buffer := make([]byte, proto.MaxMessageSize)
+	flow := w.sess.getFlow(w.streamID)
+	shaper := w.sess.getShaper(w.streamID)
+	written := 0
+	for written < len(data) {
+		n := copy(buffer[proto.HeadLength:], data[written:])
+		if flow != nil && !flow.send.Take(n) {
+			return written, io.ErrClosedPipe
+		}
+
+		head := proto.MessageHead{}
+		head.StreamType = proto.STREAM_DATA
+		head.ProtoType = proto.TCP_PROTO
+		head.StreamID = w.streamID
+		head.BodyLength = uint16(n)
+		head.Encode(buffer[0:proto.HeadLength])
+		err := shaper.Write(buffer[:proto.HeadLength+n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
 func (sess *session) writeClient(streamID uint16, data []byte) {
-	var conn net.Conn
+	var conn io.WriteCloser
 	sess.mutex.Lock()
 	v, ok := sess.clients[streamID]
 	if ok {
 		conn = v
 	}
+	flow := sess.flows[streamID]
 	sess.mutex.Unlock()
 
+	if flow != nil {
+		sess.pushFlow(streamID, flow, data)
+		return
+	}
+
 	if conn != nil {
 		_, err := conn.Write(data)
 		if err != nil {
@@ -112,14 +471,29 @@ func (sess *session) agent(remoteClosedCh chan<- *session) {
 	defer func() {
 		sess.server.Close()
 
+		sess.mutex.Lock()
+		sess.isClosed = true
+		pending := make([]uint16, 0, len(sess.pending))
+		for streamID := range sess.pending {
+			pending = append(pending, streamID)
+		}
+		sess.mutex.Unlock()
+		for _, streamID := range pending {
+			sess.streamReplied(streamID, proto.REPLY_FAILURE)
+		}
+
 		isAutoClose := false
 		sess.mutex.Lock()
 		for _, conn := range sess.clients {
 			conn.Close()
 		}
-		sess.isClosed = true
+		for _, flow := range sess.flows {
+			flow.close()
+		}
 		isAutoClose = sess.isAutoClose
 		sess.mutex.Unlock()
+		close(sess.die)
+		sessionsActive.Dec()
 
 		if !isAutoClose {
 			remoteClosedCh <- sess
@@ -136,6 +510,7 @@ func (sess *session) agent(remoteClosedCh chan<- *session) {
 
 		head := proto.MessageHead{}
 		head.Decode(buffer[:proto.HeadLength])
+		bytesDown.Add(float64(proto.HeadLength + int(head.BodyLength)))
 		if head.BodyLength > 0 {
 			if head.BodyLength > proto.MaxMessageBodySize {
 				return
@@ -146,14 +521,29 @@ func (sess *session) agent(remoteClosedCh chan<- *session) {
 			}
 		}
 
-		if head.ProtoType == proto.TCP_PROTO {
-			if head.StreamType == proto.STREAM_DEL {
-				sess.delStream(head.StreamID)
-			} else if head.StreamType == proto.STREAM_DATA {
-				sess.writeClient(head.StreamID, buffer[proto.HeadLength:proto.HeadLength+int(head.BodyLength)])
-			} else {
+		if head.StreamType == proto.STREAM_REPLY {
+			code := proto.REPLY_FAILURE
+			if head.BodyLength > 0 {
+				code = proto.ReplyCode(buffer[proto.HeadLength])
+			}
+			sess.streamReplied(head.StreamID, code)
+		} else if head.StreamType == proto.STREAM_PONG {
+			sess.pong(buffer[proto.HeadLength : proto.HeadLength+int(head.BodyLength)])
+		} else if head.StreamType == proto.STREAM_FIN {
+			sess.finStream(head.StreamID)
+		} else if head.StreamType == proto.STREAM_WINDOW_UPDATE {
+			sess.windowUpdate(head.StreamID, buffer[proto.HeadLength:proto.HeadLength+int(head.BodyLength)])
+		} else if head.StreamType == proto.STREAM_PADDING {
+		} else if proto.IsSettings(&head) {
+			settings := proto.Settings{}
+			if settings.Decode(buffer[proto.HeadLength:proto.HeadLength+int(head.BodyLength)]) != nil {
 				return
 			}
+			sess.applySettings(settings)
+		} else if head.StreamType == proto.STREAM_DEL {
+			sess.remoteDelStream(head.StreamID)
+		} else if head.StreamType == proto.STREAM_DATA {
+			sess.writeClient(head.StreamID, buffer[proto.HeadLength:proto.HeadLength+int(head.BodyLength)])
 		} else {
 			return
 		}
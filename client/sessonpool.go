@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -9,29 +10,117 @@ import (
 	faketls "github.com/ptrbug/invis/tls"
 )
 
+//dialTimeout limit the tcp connect and tls handshake with a server
+const dialTimeout = time.Second * 10
+
 type sessionPool struct {
+	name           string
 	serverAddr     string
 	fakeWebAddr    string
 	cert           faketls.Certificate
 	channelUUID    []byte
 	clientUUID     []byte
+	legacyHello    bool
+	keepalive      keepaliveConfig
 	remoteClosedCh chan *session
 
 	cond          *sync.Cond
 	tmLastSession time.Time
 	isConnecting  bool
 	curSession    *session
+	isHealthy     bool
+	rtt           time.Duration
 }
 
-func (p *sessionPool) newSessionPool(serverAddr, fakeWebDomain string, cert faketls.Certificate, channelUUID, clientUUID []byte) *sessionPool {
-	return &sessionPool{serverAddr: serverAddr,
+func (p *sessionPool) newSessionPool(name, serverAddr, fakeWebDomain string, cert faketls.Certificate, channelUUID, clientUUID []byte, legacyHello bool, keepalive keepaliveConfig) *sessionPool {
+	return &sessionPool{name: name,
+		serverAddr:     serverAddr,
 		fakeWebAddr:    fakeWebDomain,
 		cert:           cert,
 		channelUUID:    channelUUID,
 		clientUUID:     clientUUID,
+		legacyHello:    legacyHello,
+		keepalive:      keepalive,
 		remoteClosedCh: make(chan *session, 8),
 		cond:           sync.NewCond(&sync.Mutex{}),
+		isHealthy:      true,
+	}
+}
+
+func (p *sessionPool) healthy() bool {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	return p.isHealthy
+}
+
+//getRTT the handshake time of the last probe or the round trip of the
+//latest ping, 0 if unknown
+func (p *sessionPool) getRTT() time.Duration {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	return p.rtt
+}
+
+func (p *sessionPool) setHealthy(healthy bool, err error) {
+	p.cond.L.Lock()
+	changed := p.isHealthy != healthy
+	p.isHealthy = healthy
+	p.cond.L.Unlock()
+	if changed {
+		if healthy {
+			loger.Printf("server %v up\n", p.name)
+		} else {
+			reportError("server %v down, %v", p.name, err)
+		}
+	}
+}
+
+func (p *sessionPool) tlsConfig() *faketls.Config {
+	encodeHelloRandom := crypto.NewEncodeHelloTokenFunc(p.channelUUID, p.clientUUID)
+	if p.legacyHello {
+		encodeHelloRandom = crypto.NewEncodeHelloRandomFunc(p.channelUUID, p.clientUUID)
+	}
+	return &faketls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         p.fakeWebAddr,
+		ClientExtra: &faketls.ClientExtraConfig{
+			RealCertificates:        []faketls.Certificate{p.cert},
+			EncodeClientHelloRandom: encodeHelloRandom,
+		},
+	}
+}
+
+func (p *sessionPool) dial() (*faketls.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	conn, err := faketls.DialWithDialer(dialer, "tcp", p.serverAddr, p.tlsConfig())
+	if err != nil {
+		tlsHandshakes.With("failure").Inc()
+		return nil, err
 	}
+	tlsHandshakes.With("success").Inc()
+	return conn, nil
+}
+
+//probe measure a full tunnel handshake with the server
+func (p *sessionPool) probe() {
+	tmStart := time.Now()
+	conn, err := p.dial()
+	if err != nil {
+		p.setHealthy(false, err)
+		return
+	}
+	rtt := time.Since(tmStart)
+	conn.Close()
+
+	p.setRTT(rtt)
+	p.setHealthy(true, nil)
+}
+
+func (p *sessionPool) setRTT(rtt time.Duration) {
+	p.cond.L.Lock()
+	p.rtt = rtt
+	p.cond.L.Unlock()
+	serverRTT.With(p.name).Set(rtt.Seconds())
 }
 
 func (p *sessionPool) onSessionConnectSucceed(sess *session) {
@@ -48,7 +137,8 @@ func (p *sessionPool) onSessionConnectSucceed(sess *session) {
 	p.cond.Broadcast()
 }
 
-func (p *sessionPool) onSessionConnectFailed() {
+func (p *sessionPool) onSessionConnectFailed(err error) {
+	p.setHealthy(false, err)
 	p.cond.L.Lock()
 	p.isConnecting = false
 	p.cond.L.Unlock()
@@ -66,27 +156,45 @@ func (p *sessionPool) onSessionRemoteClosed(sess *session) {
 func (p *sessionPool) connect() {
 	go func() {
 		var sess *session
-		config := &faketls.Config{
-			InsecureSkipVerify: true,
-			ServerName:         p.fakeWebAddr,
-			ClientExtra: &faketls.ClientExtraConfig{
-				RealCertificates:        []faketls.Certificate{p.cert},
-				EncodeClientHelloRandom: crypto.NewEncodeHelloRandomFunc(p.channelUUID, p.clientUUID),
-			},
-		}
-		conn, err := faketls.Dial("tcp", p.serverAddr, config)
+		conn, err := p.dial()
 		if err == nil {
-			sess = newSession(conn)
+			sess = newSession(conn, p.name)
 			go sess.agent(p.remoteClosedCh)
+			//servers that still need the legacy hello have no settings either
+			if !p.legacyHello {
+				sess.sendSettings()
+			}
+			go sess.keepalive(p, p.keepalive)
 		}
 		if sess != nil {
+			sessionConnects.With(p.name, "success").Inc()
+			p.setHealthy(true, nil)
 			p.onSessionConnectSucceed(sess)
 		} else {
-			p.onSessionConnectFailed()
+			sessionConnects.With(p.name, "failure").Inc()
+			p.onSessionConnectFailed(err)
 		}
 	}()
 }
 
+//reconnect replace the current session, its streams stay on it until they end
+func (p *sessionPool) reconnect() {
+	p.cond.L.Lock()
+	if p.curSession != nil {
+		p.curSession.autoClose()
+		p.curSession = nil
+	}
+	p.tryConnectWithLock()
+	p.cond.L.Unlock()
+}
+
+//getSession the current session, nil if there is none
+func (p *sessionPool) getSession() *session {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	return p.curSession
+}
+
 func (p *sessionPool) tryConnectWithLock() {
 	if p.isConnecting == false {
 		p.isConnecting = true
@@ -94,7 +202,7 @@ func (p *sessionPool) tryConnectWithLock() {
 	}
 }
 
-func (p *sessionPool) getSessonAndStream(conn net.Conn) (sess *session, streamID uint16) {
+func (p *sessionPool) getSessonAndStream(conn io.WriteCloser) (sess *session, streamID uint16) {
 
 	tryCount := 0
 	p.cond.L.Lock()
@@ -110,6 +218,8 @@ func (p *sessionPool) getSessonAndStream(conn net.Conn) (sess *session, streamID
 	sess = p.curSession
 	streamID, ok := sess.newStream(conn)
 	if !ok {
+		//a full session is closed once its streams end
+		sess.autoClose()
 		p.curSession = nil
 		p.cond.L.Unlock()
 		return nil, 0
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net"
@@ -31,18 +32,71 @@ const (
 	addrTypeNotSupported
 )
 
+//auth methods
+const (
+	noAuthMethod       = uint8(0)
+	userPassAuthMethod = uint8(2)
+	noAcceptableMethod = uint8(0xff)
+)
+
+//username/password auth, rfc1929
+const (
+	userPassAuthVersion = uint8(1)
+	authSuccess         = uint8(0)
+	authFailure         = uint8(1)
+)
+
 func handShake(conn net.Conn, version byte, numMethods int, methods []byte) bool {
 	if version != socks5Version {
 		return false
 	}
-	resp := []byte{socks5Version, 0}
+	method := noAuthMethod
+	if auth.required() {
+		method = userPassAuthMethod
+		if bytes.IndexByte(methods[:numMethods], method) == -1 {
+			conn.Write([]byte{socks5Version, noAcceptableMethod})
+			return false
+		}
+	}
+	resp := []byte{socks5Version, method}
 	_, err := conn.Write(resp)
 	if err != nil {
 		return false
 	}
+	if method == userPassAuthMethod {
+		return authenticate(conn)
+	}
 	return true
 }
 
+func authenticate(conn net.Conn) bool {
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return false
+	}
+	if header[0] != userPassAuthVersion {
+		return false
+	}
+	username := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return false
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return false
+	}
+	password := make([]byte, int(header[0]))
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return false
+	}
+
+	if !auth.check(string(username), string(password)) {
+		conn.Write([]byte{userPassAuthVersion, authFailure})
+		return false
+	}
+	_, err := conn.Write([]byte{userPassAuthVersion, authSuccess})
+	return err == nil
+}
+
 func readAddr(r io.Reader) (*proto.SOCKS5Address, bool) {
 	d := &proto.SOCKS5Address{}
 
@@ -93,6 +147,23 @@ func readAddr(r io.Reader) (*proto.SOCKS5Address, bool) {
 	return d, true
 }
 
+//socks5Reply the reply for the outcome of opening a stream
+func socks5Reply(code proto.ReplyCode) uint8 {
+	switch code {
+	case proto.REPLY_SUCCEEDED:
+		return successReply
+	case proto.REPLY_REFUSED:
+		return connectionRefused
+	case proto.REPLY_UNREACHABLE, proto.REPLY_DNS_FAILURE:
+		return hostUnreachable
+	case proto.REPLY_DENIED:
+		return ruleFailure
+	case proto.REPLY_TIMEOUT:
+		return ttlExpired
+	}
+	return serverFailure
+}
+
 // sendReply is used to send a reply message
 func sendReply(w io.Writer, resp uint8, d *proto.SOCKS5Address) error {
 	// Format the address
@@ -139,7 +210,7 @@ func sendReply(w io.Writer, resp uint8, d *proto.SOCKS5Address) error {
 	return err
 }
 
-func handleSocks5Request(conn net.Conn, firstPacket []byte) {
+func handleSocks5Request(conn *trackedConn, firstPacket []byte) {
 	defer conn.Close()
 
 	//handshake
@@ -164,8 +235,9 @@ func handleSocks5Request(conn net.Conn, firstPacket []byte) {
 		return
 	}
 	cmd := header[1]
-	if cmd != ConnectCommand {
+	if cmd != ConnectCommand && cmd != AssociateCommand {
 		sendReply(conn, commandNotSupported, nil)
+		return
 	}
 
 	address, ok := readAddr(conn)
@@ -174,42 +246,49 @@ func handleSocks5Request(conn net.Conn, firstPacket []byte) {
 		return
 	}
 
-	sess, streamID := pool.getSessonAndStream(conn)
-	if sess == nil {
-		sendReply(conn, hostUnreachable, nil)
+	if cmd == AssociateCommand {
+		handleSocks5Associate(conn)
 		return
 	}
-	defer sess.delStream(streamID)
 
-	err := sendReply(conn, successReply, address)
-	if err != nil {
+	action := routing.route(address)
+	conn.setRequest(frontendSOCKS5, address.String(), action)
+	switch action {
+	case routeBlock:
+		sendReply(conn, ruleFailure, nil)
+		return
+	case routeDirect:
+		remote, err := dialDirect(address)
+		if err != nil {
+			sendReply(conn, hostUnreachable, nil)
+			return
+		}
+		if err := sendReply(conn, successReply, address); err != nil {
+			remote.Close()
+			return
+		}
+		relayDirect(conn, conn, remote)
 		return
 	}
 
-	err = sess.writeServerStreamNew(address, streamID)
-	if err != nil {
+	sess, streamID := servers.getSessonAndStream(conn)
+	if sess == nil {
+		sendReply(conn, hostUnreachable, nil)
 		return
 	}
+	defer sess.delStream(streamID)
+	conn.setStream(sess, streamID)
 
-	//forward
-	buffer := make([]byte, proto.MaxMessageSize)
-
-	for {
-		n, err := conn.Read(buffer[proto.HeadLength:])
-		if err != nil {
-			sess.writeServerStreamDel(streamID)
-			return
-		}
-
-		head := proto.MessageHead{}
-		head.StreamType = proto.STREAM_DATA
-		head.ProtoType = proto.TCP_PROTO
-		head.StreamID = streamID
-		head.BodyLength = uint16(n)
-		head.Encode(buffer[0:proto.HeadLength])
-		err = sess.writeServer(buffer[:proto.HeadLength+n])
-		if err != nil {
-			return
+	code := sess.openStream(streamID, address, func(code proto.ReplyCode) {
+		if code == proto.REPLY_SUCCEEDED {
+			sendReply(conn, successReply, address)
+		} else {
+			sendReply(conn, socks5Reply(code), nil)
 		}
+	})
+	if code != proto.REPLY_SUCCEEDED {
+		return
 	}
+
+	sess.forward(streamID, conn)
 }
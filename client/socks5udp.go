@@ -0,0 +1,245 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ptrbug/invis/proto"
+)
+
+//socks5 udp request header: RSV(2) FRAG(1)
+const udpHeaderLength = 3
+
+//udpRouteTTL how long the route of a udp destination is reused, so not every
+//datagram matches the rules, resolves the domain and logs the match
+const udpRouteTTL = time.Second * 60
+
+//maxUDPRoutes the most destinations cached by one associate
+const maxUDPRoutes = 256
+
+type udpRoute struct {
+	mode    string
+	action  routeAction
+	expires time.Time
+}
+
+//udpRoutes the routes of the destinations of one associate, only its relay loop uses it
+type udpRoutes struct {
+	routes map[string]*udpRoute
+}
+
+//route a switch of the routing mode takes effect at once
+func (c *udpRoutes) route(address *proto.SOCKS5Address) routeAction {
+	key := address.String()
+	mode := routing.getMode()
+	now := time.Now()
+	if r, ok := c.routes[key]; ok && r.mode == mode && now.Before(r.expires) {
+		return r.action
+	}
+	action := routing.route(address)
+	if c.routes == nil || len(c.routes) >= maxUDPRoutes {
+		c.routes = make(map[string]*udpRoute)
+	}
+	c.routes[key] = &udpRoute{mode: mode, action: action, expires: now.Add(udpRouteTTL)}
+	return action
+}
+
+//udpRelay the local udp socket of one associate, datagrams from the
+//server are wrapped with the socks5 udp header and sent to the application
+type udpRelay struct {
+	conn  *net.UDPConn
+	track *trackedConn
+
+	mutex      sync.Mutex
+	clientAddr *net.UDPAddr
+	direct     *net.UDPConn
+	isClosed   bool
+}
+
+func (relay *udpRelay) getClientAddr() *net.UDPAddr {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	return relay.clientAddr
+}
+
+//acceptFrom only the first sender from the host of the control connection is relayed
+func (relay *udpRelay) acceptFrom(from *net.UDPAddr, clientIP net.IP) bool {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	if relay.clientAddr == nil {
+		if !from.IP.Equal(clientIP) {
+			return false
+		}
+		relay.clientAddr = from
+		return true
+	}
+	return relay.clientAddr.IP.Equal(from.IP) && relay.clientAddr.Port == from.Port
+}
+
+//Write data is a SOCKS5Address followed by the payload
+func (relay *udpRelay) Write(data []byte) (int, error) {
+	clientAddr := relay.getClientAddr()
+	if clientAddr == nil {
+		return len(data), nil
+	}
+	packet := make([]byte, udpHeaderLength+len(data))
+	copy(packet[udpHeaderLength:], data)
+	n, err := relay.conn.WriteToUDP(packet, clientAddr)
+	relay.track.addDown(n)
+	return len(data), err
+}
+
+func (relay *udpRelay) Close() error {
+	relay.mutex.Lock()
+	relay.isClosed = true
+	if relay.direct != nil {
+		relay.direct.Close()
+	}
+	relay.mutex.Unlock()
+	return relay.conn.Close()
+}
+
+//sendDirect send a datagram without the tunnel, the replies come back on the same socket
+func (relay *udpRelay) sendDirect(addr *proto.SOCKS5Address, payload []byte) {
+	relay.mutex.Lock()
+	if relay.isClosed {
+		relay.mutex.Unlock()
+		return
+	}
+	if relay.direct == nil {
+		direct, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			relay.mutex.Unlock()
+			return
+		}
+		relay.direct = direct
+		go relay.readDirect(direct)
+	}
+	direct := relay.direct
+	relay.mutex.Unlock()
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return
+	}
+	direct.WriteToUDP(payload, udpAddr)
+}
+
+func (relay *udpRelay) readDirect(direct *net.UDPConn) {
+	//room for the socks5 udp header and the longest ip address
+	const maxHeaderLength = udpHeaderLength + 19
+	var buffer [proto.MaxMessageSize]byte
+	for {
+		n, from, err := direct.ReadFromUDP(buffer[maxHeaderLength:])
+		if err != nil {
+			return
+		}
+		clientAddr := relay.getClientAddr()
+		if clientAddr == nil {
+			continue
+		}
+		var addrBuf [19]byte
+		addrLen, err := proto.NewSOCKS5Address(from.IP, from.Port).Encode(addrBuf[:])
+		if err != nil {
+			continue
+		}
+		start := maxHeaderLength - addrLen - udpHeaderLength
+		copy(buffer[start:start+udpHeaderLength], []byte{0, 0, 0})
+		copy(buffer[start+udpHeaderLength:], addrBuf[:addrLen])
+		written, _ := relay.conn.WriteToUDP(buffer[start:maxHeaderLength+n], clientAddr)
+		relay.track.addDown(written)
+	}
+}
+
+func handleSocks5Associate(conn *trackedConn) {
+
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		sendReply(conn, serverFailure, nil)
+		return
+	}
+	relay := &udpRelay{conn: udpConn, track: conn}
+	conn.setRequest(frontendSOCKS5, "udp "+udpConn.LocalAddr().String(), "")
+	defer relay.Close()
+
+	sess, streamID := servers.getSessonAndStream(relay)
+	if sess == nil {
+		sendReply(conn, hostUnreachable, nil)
+		return
+	}
+	defer sess.delStream(streamID)
+	conn.setStream(sess, streamID)
+	if !sess.supportsUDP() {
+		sendReply(conn, commandNotSupported, nil)
+		return
+	}
+
+	bindAddr := udpConn.LocalAddr().(*net.UDPAddr)
+	code := sess.openStream(streamID, nil, func(code proto.ReplyCode) {
+		if code == proto.REPLY_SUCCEEDED {
+			sendReply(conn, successReply, proto.NewSOCKS5Address(bindAddr.IP, bindAddr.Port))
+		} else {
+			sendReply(conn, socks5Reply(code), nil)
+		}
+	})
+	if code != proto.REPLY_SUCCEEDED {
+		return
+	}
+
+	//the association ends when the control connection is closed
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		relay.Close()
+	}()
+
+	//the socks5 udp header is read into the tail of the message head,
+	//so the datagram only has to be framed in place
+	buffer := make([]byte, proto.MaxMessageSize)
+	shaper := sess.getShaper(streamID)
+	routes := &udpRoutes{}
+	for {
+		n, from, err := udpConn.ReadFromUDP(buffer[proto.HeadLength-udpHeaderLength:])
+		if err != nil {
+			sess.writeServerStreamDel(streamID)
+			return
+		}
+		if n <= udpHeaderLength || !relay.acceptFrom(from, clientIP) {
+			continue
+		}
+		conn.addUp(n)
+		//fragmented datagrams are not supported
+		if buffer[proto.HeadLength-1] != 0 {
+			continue
+		}
+		body := buffer[proto.HeadLength : proto.HeadLength-udpHeaderLength+n]
+		address := &proto.SOCKS5Address{}
+		addrLen, err := address.Decode(body)
+		if err != nil {
+			continue
+		}
+		switch routes.route(address) {
+		case routeBlock:
+			continue
+		case routeDirect:
+			relay.sendDirect(address, body[addrLen:])
+			continue
+		}
+
+		head := proto.MessageHead{}
+		head.StreamType = proto.STREAM_DATA
+		head.ProtoType = proto.UPD_PROTO
+		head.StreamID = streamID
+		head.BodyLength = uint16(len(body))
+		head.Encode(buffer[0:proto.HeadLength])
+		err = shaper.Write(buffer[:proto.HeadLength+len(body)])
+		if err != nil {
+			return
+		}
+	}
+}
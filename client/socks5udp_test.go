@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/ptrbug/invis/proto"
+)
+
+func TestUDPRoutesCached(t *testing.T) {
+	loger = log.New(ioutil.Discard, "", 0)
+	r, err := newRouter(routingConfig{Rules: []ruleConfig{{Type: ruleDomain, Value: "example.com", Action: routeBlock}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matched := 0
+	match := r.rules[0].match
+	r.rules[0].match = func(target *routeTarget) bool {
+		matched++
+		return match(target)
+	}
+	routing = r
+
+	routes := &udpRoutes{}
+	blocked := &proto.SOCKS5Address{AddressType: proto.DOMAINNAME, FQDN: "example.com", Port: 53}
+	other := &proto.SOCKS5Address{AddressType: proto.DOMAINNAME, FQDN: "example.org", Port: 53}
+	for i := 0; i < 3; i++ {
+		if action := routes.route(blocked); action != routeBlock {
+			t.Fatalf("route = %v, want block", action)
+		}
+	}
+	if matched != 1 {
+		t.Errorf("rules matched %v times for one destination", matched)
+	}
+	if action := routes.route(other); action != routeProxy || matched != 2 {
+		t.Errorf("other destination %v, rules matched %v times", action, matched)
+	}
+
+	//a mode switch is not hidden by the cache
+	r.setMode(routeModeGlobal)
+	if action := routes.route(blocked); action != routeProxy {
+		t.Errorf("global mode route = %v", action)
+	}
+	r.setMode(routeModeRule)
+	if action := routes.route(blocked); action != routeBlock || matched != 3 {
+		t.Errorf("rule mode route = %v, rules matched %v times", action, matched)
+	}
+}
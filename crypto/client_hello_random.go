@@ -16,7 +16,7 @@ func NewEncodeHelloRandomFunc(channelUUID, clientUUID []byte) func(random []byte
 	}
 }
 
-//EncodeHelloRandom encode client hello random
+//EncodeHelloRandom encode client hello random in the legacy v1 format, see EncodeHelloToken
 func EncodeHelloRandom(random []byte, r io.Reader, channelUUID, clientUUID []byte) error {
 
 	binary.LittleEndian.PutUint32(random[0:4], uint32(time.Now().Unix()))
@@ -35,7 +35,7 @@ func EncodeHelloRandom(random []byte, r io.Reader, channelUUID, clientUUID []byt
 	return nil
 }
 
-//DecodeHelloRandom decode client hello random
+//DecodeHelloRandom decode client hello random of the legacy v1 format
 func DecodeHelloRandom(random []byte, channelUUID []byte) (clientUUID uuid.UUID) {
 
 	decrypted := AesDecryptCBC(random[16:32], channelUUID)
@@ -46,3 +46,8 @@ func DecodeHelloRandom(random []byte, channelUUID []byte) (clientUUID uuid.UUID)
 	copy(clientUUID[:], decrypted)
 	return clientUUID
 }
+
+//HelloRandomTime the time a client hello random was encoded at
+func HelloRandomTime(random []byte) time.Time {
+	return time.Unix(int64(binary.LittleEndian.Uint32(random[0:4])), 0)
+}
@@ -0,0 +1,124 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+)
+
+//the v2 client hello random
+//  [0:12]  random nonce
+//  [12:16] little endian unix timestamp, xor masked with HMAC(maskKey, nonce)
+//  [16:32] HMAC-SHA256(clientKey, version || nonce || timestamp) truncated
+//maskKey and clientKey are derived by HKDF from the channel uuid, a client is
+//found by checking the tag with the key of every client
+const (
+	helloTokenVersion = 2
+	helloNonceLength  = 12
+	helloTagLength    = 16
+)
+
+var helloTokenSalt = []byte("invis hello token v2")
+
+func helloTokenKey(channelUUID []byte, info []byte) []byte {
+	key := make([]byte, sha256.Size)
+	io.ReadFull(hkdf.New(sha256.New, channelUUID, helloTokenSalt, info), key)
+	return key
+}
+
+func helloMaskKey(channelUUID []byte) []byte {
+	return helloTokenKey(channelUUID, []byte("mask"))
+}
+
+func helloClientKey(channelUUID, clientUUID []byte) []byte {
+	return helloTokenKey(channelUUID, append([]byte("client "), clientUUID...))
+}
+
+func helloTimeMask(maskKey []byte, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, maskKey)
+	mac.Write(nonce)
+	return mac.Sum(nil)[:4]
+}
+
+func helloTag(clientKey []byte, nonce []byte, timestamp []byte) []byte {
+	mac := hmac.New(sha256.New, clientKey)
+	mac.Write([]byte{helloTokenVersion})
+	mac.Write(nonce)
+	mac.Write(timestamp)
+	return mac.Sum(nil)[:helloTagLength]
+}
+
+//NewEncodeHelloTokenFunc bind args
+func NewEncodeHelloTokenFunc(channelUUID, clientUUID []byte) func(random []byte, r io.Reader) error {
+	maskKey := helloMaskKey(channelUUID)
+	clientKey := helloClientKey(channelUUID, clientUUID)
+	return func(random []byte, r io.Reader) error {
+		return encodeHelloToken(random, r, maskKey, clientKey, time.Now())
+	}
+}
+
+//EncodeHelloToken encode client hello random in the v2 format
+func EncodeHelloToken(random []byte, r io.Reader, channelUUID, clientUUID []byte) error {
+	return encodeHelloToken(random, r, helloMaskKey(channelUUID), helloClientKey(channelUUID, clientUUID), time.Now())
+}
+
+func encodeHelloToken(random []byte, r io.Reader, maskKey, clientKey []byte, now time.Time) error {
+	nonce := random[0:helloNonceLength]
+	_, err := io.ReadFull(r, nonce)
+	if err != nil {
+		return errors.New("tls: short read from Rand: " + err.Error())
+	}
+	var timestamp [4]byte
+	binary.LittleEndian.PutUint32(timestamp[:], uint32(now.Unix()))
+	copy(random[helloNonceLength+4:], helloTag(clientKey, nonce, timestamp[:]))
+
+	mask := helloTimeMask(maskKey, nonce)
+	for i := range timestamp {
+		random[helloNonceLength+i] = timestamp[i] ^ mask[i]
+	}
+	return nil
+}
+
+type helloClient struct {
+	uuid uuid.UUID
+	key  []byte
+}
+
+//HelloTokenVerifier check v2 client hello randoms of one channel
+type HelloTokenVerifier struct {
+	maskKey []byte
+	clients []helloClient
+}
+
+//NewHelloTokenVerifier derive the keys of all clients
+func NewHelloTokenVerifier(channelUUID []byte, clientUUIDs []uuid.UUID) *HelloTokenVerifier {
+	v := &HelloTokenVerifier{maskKey: helloMaskKey(channelUUID)}
+	for _, id := range clientUUIDs {
+		v.clients = append(v.clients, helloClient{uuid: id, key: helloClientKey(channelUUID, id[:])})
+	}
+	return v
+}
+
+//Verify find the client of random, ok is false if no client key matches
+func (v *HelloTokenVerifier) Verify(random []byte) (clientUUID uuid.UUID, tm time.Time, ok bool) {
+	nonce := random[0:helloNonceLength]
+	var timestamp [4]byte
+	mask := helloTimeMask(v.maskKey, nonce)
+	for i := range timestamp {
+		timestamp[i] = random[helloNonceLength+i] ^ mask[i]
+	}
+	tag := random[helloNonceLength+4 : helloNonceLength+4+helloTagLength]
+	for _, client := range v.clients {
+		if subtle.ConstantTimeCompare(helloTag(client.key, nonce, timestamp[:]), tag) == 1 {
+			return client.uuid, time.Unix(int64(binary.LittleEndian.Uint32(timestamp[:])), 0), true
+		}
+	}
+	return clientUUID, tm, false
+}
@@ -0,0 +1,109 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	helloTestChannel = uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	helloTestClients = []uuid.UUID{
+		uuid.MustParse("a5f8f489-de00-4865-8263-9b7e04e0f252"),
+		uuid.MustParse("2c5ea4c0-4067-11e9-8bad-9b1deb4d3b7d"),
+		uuid.MustParse("f47ac10b-58cc-4372-a567-0e02b2c3d479"),
+	}
+)
+
+func TestHelloTokenRoundTrip(t *testing.T) {
+	v := NewHelloTokenVerifier(helloTestChannel[:], helloTestClients)
+	for _, client := range helloTestClients {
+		random := make([]byte, 32)
+		before := time.Now().Unix()
+		if err := EncodeHelloToken(random, rand.Reader, helloTestChannel[:], client[:]); err != nil {
+			t.Fatal(err)
+		}
+		got, tm, ok := v.Verify(random)
+		if !ok || got != client {
+			t.Errorf("%v: verified as %v %v", client, got, ok)
+		}
+		if tm.Unix() < before || tm.Unix() > time.Now().Unix() {
+			t.Errorf("%v: timestamp %v", client, tm)
+		}
+
+		encode := NewEncodeHelloTokenFunc(helloTestChannel[:], client[:])
+		if err := encode(random, rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+		if got, _, ok := v.Verify(random); !ok || got != client {
+			t.Errorf("%v: bound func verified as %v %v", client, got, ok)
+		}
+	}
+}
+
+//the timestamp is recovered exactly, so the server can reject skewed hellos
+func TestHelloTokenTimestamp(t *testing.T) {
+	v := NewHelloTokenVerifier(helloTestChannel[:], helloTestClients)
+	client := helloTestClients[1]
+	maskKey := helloMaskKey(helloTestChannel[:])
+	clientKey := helloClientKey(helloTestChannel[:], client[:])
+	for _, now := range []time.Time{time.Unix(0, 0), time.Unix(1600000000, 0), time.Now().Add(-time.Hour), time.Now().Add(time.Hour)} {
+		random := make([]byte, 32)
+		if err := encodeHelloToken(random, rand.Reader, maskKey, clientKey, now); err != nil {
+			t.Fatal(err)
+		}
+		_, tm, ok := v.Verify(random)
+		if !ok || tm.Unix() != now.Unix() {
+			t.Errorf("encoded at %v, verified %v at %v", now, ok, tm)
+		}
+	}
+}
+
+func TestHelloTokenRejected(t *testing.T) {
+	v := NewHelloTokenVerifier(helloTestChannel[:], helloTestClients)
+	client := helloTestClients[0]
+	random := make([]byte, 32)
+	if err := EncodeHelloToken(random, rand.Reader, helloTestChannel[:], client[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	//every bit of nonce, masked timestamp and tag is covered
+	for i := 0; i < 32*8; i++ {
+		tampered := append([]byte(nil), random...)
+		tampered[i/8] ^= 1 << (i % 8)
+		if _, _, ok := v.Verify(tampered); ok {
+			t.Fatalf("bit %v flipped: accepted", i)
+		}
+	}
+
+	other := uuid.MustParse("00000000-0000-4000-8000-000000000000")
+	tests := []struct {
+		name     string
+		verifier *HelloTokenVerifier
+	}{
+		{"other channel", NewHelloTokenVerifier(other[:], helloTestClients)},
+		{"unknown client", NewHelloTokenVerifier(helloTestChannel[:], helloTestClients[1:])},
+		{"no clients", NewHelloTokenVerifier(helloTestChannel[:], nil)},
+	}
+	for _, tt := range tests {
+		if _, _, ok := tt.verifier.Verify(random); ok {
+			t.Errorf("%v: accepted", tt.name)
+		}
+	}
+}
+
+func TestHelloTokenNonce(t *testing.T) {
+	a, b := make([]byte, 32), make([]byte, 32)
+	client := helloTestClients[0]
+	EncodeHelloToken(a, rand.Reader, helloTestChannel[:], client[:])
+	EncodeHelloToken(b, rand.Reader, helloTestChannel[:], client[:])
+	if bytes.Equal(a, b) {
+		t.Error("two tokens are equal")
+	}
+	if err := EncodeHelloToken(a, bytes.NewReader(nil), helloTestChannel[:], client[:]); err == nil {
+		t.Error("short read accepted")
+	}
+}
@@ -0,0 +1,256 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	faketls "github.com/ptrbug/invis/tls"
+	"golang.org/x/crypto/hkdf"
+)
+
+//key types of the certificate derived from a client uuid, client and server must use the same
+const (
+	KeyTypeEd25519   = "ed25519"
+	KeyTypeECDSAP256 = "ecdsa-p256"
+	KeyTypeRSA       = "rsa"
+)
+
+var keyDerivationSalt = []byte("invis key pair v1")
+
+//keyReader the key material of uuid, different for every key type
+func keyReader(id []byte, keyType string) io.Reader {
+	return hkdf.New(sha256.New, id, keyDerivationSalt, []byte(keyType))
+}
+
+//deterministicSigner an ecdsa signer with the nonce of RFC 6979, client and
+//server derive the certificate on their own and need the same bytes
+type deterministicSigner struct {
+	priv *ecdsa.PrivateKey
+}
+
+func (s *deterministicSigner) Public() crypto.PublicKey {
+	return &s.priv.PublicKey
+}
+
+func (s *deterministicSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := crypto.SHA256
+	if opts != nil && opts.HashFunc() != 0 {
+		hash = opts.HashFunc()
+	}
+	n := s.priv.Curve.Params().N
+	e := bits2int(digest, n)
+
+	for nonce := newRFC6979Nonce(hash, s.priv.D, digest, n); ; {
+		k := nonce.next()
+		x, _ := s.priv.Curve.ScalarBaseMult(k.Bytes())
+		r := new(big.Int).Mod(x, n)
+		if r.Sign() == 0 {
+			continue
+		}
+		sig := new(big.Int).Mul(r, s.priv.D)
+		sig.Add(sig, e)
+		sig.Mul(sig, new(big.Int).ModInverse(k, n))
+		sig.Mod(sig, n)
+		if sig.Sign() == 0 {
+			continue
+		}
+		return asn1.Marshal(struct{ R, S *big.Int }{r, sig})
+	}
+}
+
+//bits2int the leftmost bits of b as an integer of the bit length of n, RFC 6979 2.3.2
+func bits2int(b []byte, n *big.Int) *big.Int {
+	v := new(big.Int).SetBytes(b)
+	if excess := len(b)*8 - n.BitLen(); excess > 0 {
+		v.Rsh(v, uint(excess))
+	}
+	return v
+}
+
+//int2octets v as a big endian of the byte length of n, RFC 6979 2.3.3
+func int2octets(v, n *big.Int) []byte {
+	out := make([]byte, (n.BitLen()+7)/8)
+	b := v.Bytes()
+	copy(out[len(out)-len(b):], b)
+	return out
+}
+
+//rfc6979Nonce the HMAC_DRBG of RFC 6979 3.2
+type rfc6979Nonce struct {
+	hash crypto.Hash
+	n    *big.Int
+	k, v []byte
+	used bool
+}
+
+func newRFC6979Nonce(hash crypto.Hash, x *big.Int, digest []byte, n *big.Int) *rfc6979Nonce {
+	h1 := bits2int(digest, n)
+	if h1.Cmp(n) >= 0 {
+		h1.Sub(h1, n)
+	}
+	key := append(int2octets(x, n), int2octets(h1, n)...)
+	g := &rfc6979Nonce{hash: hash, n: n,
+		k: make([]byte, hash.Size()),
+		v: bytes.Repeat([]byte{1}, hash.Size())}
+	g.k = g.mac(g.v, []byte{0}, key)
+	g.v = g.mac(g.v)
+	g.k = g.mac(g.v, []byte{1}, key)
+	g.v = g.mac(g.v)
+	return g
+}
+
+func (g *rfc6979Nonce) mac(data ...[]byte) []byte {
+	m := hmac.New(g.hash.New, g.k)
+	for _, d := range data {
+		m.Write(d)
+	}
+	return m.Sum(nil)
+}
+
+//next a candidate k in [1, n-1], each call after the first is the retry of 3.2 h.3
+func (g *rfc6979Nonce) next() *big.Int {
+	for {
+		if g.used {
+			g.k = g.mac(g.v, []byte{0})
+			g.v = g.mac(g.v)
+		}
+		g.used = true
+		t := make([]byte, 0, (g.n.BitLen()+7)/8)
+		for len(t) < cap(t) {
+			g.v = g.mac(g.v)
+			t = append(t, g.v...)
+		}
+		k := bits2int(t, g.n)
+		if k.Sign() > 0 && k.Cmp(g.n) < 0 {
+			return k
+		}
+	}
+}
+
+//scalarFromBytes map b to [1, n-1]
+func scalarFromBytes(b []byte, n *big.Int) *big.Int {
+	k := new(big.Int).SetBytes(b)
+	nMinusOne := new(big.Int).Sub(n, big.NewInt(1))
+	k.Mod(k, nMinusOne)
+	return k.Add(k, big.NewInt(1))
+}
+
+func deriveECDSAP256Key(id []byte) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	//8 extra bytes make the bias of the modular reduction negligible
+	seed := make([]byte, curve.Params().BitSize/8+8)
+	if _, err := io.ReadFull(keyReader(id, KeyTypeECDSAP256), seed); err != nil {
+		return nil, err
+	}
+	priv := &ecdsa.PrivateKey{}
+	priv.Curve = curve
+	priv.D = scalarFromBytes(seed, curve.Params().N)
+	priv.X, priv.Y = curve.ScalarBaseMult(priv.D.Bytes())
+	return priv, nil
+}
+
+func encodeKeyPair(derCert []byte, privateKey interface{}) (faketls.Certificate, error) {
+	derKey, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return faketls.Certificate{}, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derCert})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: derKey})
+	return faketls.X509KeyPair(certPEM, keyPEM)
+}
+
+//CreateKeyPair derive the certificate of a client uuid
+func CreateKeyPair(id []byte, keyType string) (faketls.Certificate, error) {
+	tpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+	}
+
+	switch keyType {
+	case KeyTypeEd25519:
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := io.ReadFull(keyReader(id, KeyTypeEd25519), seed); err != nil {
+			return faketls.Certificate{}, err
+		}
+		privateKey := ed25519.NewKeyFromSeed(seed)
+		derCert, err := x509.CreateCertificate(cryptorand.Reader, &tpl, &tpl, privateKey.Public(), privateKey)
+		if err != nil {
+			return faketls.Certificate{}, err
+		}
+		return encodeKeyPair(derCert, privateKey)
+
+	case KeyTypeECDSAP256:
+		privateKey, err := deriveECDSAP256Key(id)
+		if err != nil {
+			return faketls.Certificate{}, err
+		}
+		derCert, err := x509.CreateCertificate(cryptorand.Reader, &tpl, &tpl, &privateKey.PublicKey, &deterministicSigner{privateKey})
+		if err != nil {
+			return faketls.Certificate{}, err
+		}
+		return encodeKeyPair(derCert, privateKey)
+
+	case "", KeyTypeRSA:
+		return CreateX509KeyPair(id, 2048)
+	}
+	return faketls.Certificate{}, fmt.Errorf("unknown key type:%v", keyType)
+}
+
+//LoadOrCreateKeyPair the certificate of a client uuid from the cache dir, it is derived
+//and saved if not cached yet. an empty dir disables the cache. The default key
+//type is rsa, which every client and server supports
+func LoadOrCreateKeyPair(dir string, id []byte, keyType string) (faketls.Certificate, error) {
+	if keyType == "" {
+		keyType = KeyTypeRSA
+	}
+	if dir == "" {
+		return CreateKeyPair(id, keyType)
+	}
+
+	clientUUID, err := uuid.FromBytes(id)
+	if err != nil {
+		return faketls.Certificate{}, err
+	}
+	path := filepath.Join(dir, clientUUID.String()+"."+keyType+".pem")
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if cert, err := faketls.X509KeyPair(data, data); err == nil {
+			return cert, nil
+		}
+	}
+
+	cert, err := CreateKeyPair(id, keyType)
+	if err != nil {
+		return cert, err
+	}
+
+	buf := &bytes.Buffer{}
+	for _, der := range cert.Certificate {
+		pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	derKey, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return cert, err
+	}
+	pem.Encode(buf, &pem.Block{Type: "PRIVATE KEY", Bytes: derKey})
+
+	//a cache that can not be written only costs time at the next start
+	if err := os.MkdirAll(dir, 0700); err == nil {
+		ioutil.WriteFile(path, buf.Bytes(), 0600)
+	}
+	return cert, nil
+}
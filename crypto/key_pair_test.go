@@ -0,0 +1,96 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+func hexInt(t *testing.T, s string) *big.Int {
+	v, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		t.Fatalf("bad hex %v", s)
+	}
+	return v
+}
+
+//RFC 6979 A.2.5, P-256 with SHA-256
+func TestDeterministicSignerRFC6979(t *testing.T) {
+	priv := &ecdsa.PrivateKey{}
+	priv.Curve = elliptic.P256()
+	priv.D = hexInt(t, "C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721")
+	priv.X, priv.Y = priv.Curve.ScalarBaseMult(priv.D.Bytes())
+
+	tests := []struct {
+		message string
+		k, r, s string
+	}{
+		{"sample",
+			"A6E3C57DD01ABE90086538398355DD4C3B17AA873382B0F24D6129493D8AAD60",
+			"EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716",
+			"F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8"},
+		{"test",
+			"D16B6AE827F17175E040871A1C7EC3500192C4C92677336EC2537ACAEE0008E0",
+			"F1ABB023518351CD71D881567B1EA663ED3EFCF6C5132B354F28D3B0B7D38367",
+			"019F4113742A2B14BD25926B49C649155F267E60D3814B4C0CC84250E46F0083"},
+	}
+	for _, tt := range tests {
+		digest := sha256.Sum256([]byte(tt.message))
+		n := priv.Curve.Params().N
+		if k := newRFC6979Nonce(crypto.SHA256, priv.D, digest[:], n).next(); k.Cmp(hexInt(t, tt.k)) != 0 {
+			t.Errorf("%v: k = %X, want %v", tt.message, k, tt.k)
+		}
+
+		der, err := (&deterministicSigner{priv}).Sign(nil, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sig struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(der, &sig); err != nil {
+			t.Fatal(err)
+		}
+		if sig.R.Cmp(hexInt(t, tt.r)) != 0 || sig.S.Cmp(hexInt(t, tt.s)) != 0 {
+			t.Errorf("%v: signature = %X %X", tt.message, sig.R, sig.S)
+		}
+		if !ecdsa.Verify(&priv.PublicKey, digest[:], sig.R, sig.S) {
+			t.Errorf("%v: signature does not verify", tt.message)
+		}
+	}
+}
+
+func TestCreateKeyPairDeterministic(t *testing.T) {
+	id, _ := hex.DecodeString("a5f8f489de00486582639b7e04e0f252")
+	for _, keyType := range []string{KeyTypeEd25519, KeyTypeECDSAP256} {
+		a, err := CreateKeyPair(id, keyType)
+		if err != nil {
+			t.Fatalf("%v: %v", keyType, err)
+		}
+		b, err := CreateKeyPair(id, keyType)
+		if err != nil {
+			t.Fatalf("%v: %v", keyType, err)
+		}
+		if !bytes.Equal(a.Certificate[0], b.Certificate[0]) {
+			t.Errorf("%v: certificates differ", keyType)
+		}
+		cert, err := x509.ParseCertificate(a.Certificate[0])
+		if err != nil {
+			t.Fatalf("%v: %v", keyType, err)
+		}
+		if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+			t.Errorf("%v: %v", keyType, err)
+		}
+	}
+}
+
+func TestCreateKeyPairUnknownType(t *testing.T) {
+	if _, err := CreateKeyPair(make([]byte, 16), "dsa"); err == nil {
+		t.Error("unknown key type accepted")
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/ptrbug/invis
 
-go 1.14
+go 1.16
 
 require (
 	github.com/ProtonMail/go-autostart v0.0.0-20181114175602-c5272053443a
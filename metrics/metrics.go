@@ -0,0 +1,250 @@
+//Package metrics a minimal registry of counters and gauges written in the prometheus text format
+//https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//metric types
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+)
+
+type family struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+
+	mutex  sync.Mutex
+	series map[string]*series
+	fn     func() float64
+}
+
+type series struct {
+	bits        uint64
+	labelValues []string
+}
+
+func (s *series) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&s.bits)
+		next := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&s.bits, old, next) {
+			return
+		}
+	}
+}
+
+func (s *series) set(v float64) {
+	atomic.StoreUint64(&s.bits, math.Float64bits(v))
+}
+
+func (s *series) value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.bits))
+}
+
+func (f *family) with(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic("metrics: " + f.name + " wrong number of label values")
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		f.series[key] = s
+	}
+	return s
+}
+
+//Registry nop
+type Registry struct {
+	mutex    sync.Mutex
+	families []*family
+}
+
+//DefaultRegistry the registry the New functions register to
+var DefaultRegistry = &Registry{}
+
+func (r *Registry) register(name, help, typ string, labelNames []string) *family {
+	f := &family{name: name, help: help, typ: typ, labelNames: labelNames, series: make(map[string]*series)}
+	r.mutex.Lock()
+	r.families = append(r.families, f)
+	r.mutex.Unlock()
+	return f
+}
+
+//Counter a value that only goes up
+type Counter struct {
+	s *series
+}
+
+//Inc nop
+func (c Counter) Inc() {
+	c.s.add(1)
+}
+
+//Add v must not be negative
+func (c Counter) Add(v float64) {
+	c.s.add(v)
+}
+
+//Value nop
+func (c Counter) Value() float64 {
+	return c.s.value()
+}
+
+//Gauge a value that goes up and down
+type Gauge struct {
+	s *series
+}
+
+//Inc nop
+func (g Gauge) Inc() {
+	g.s.add(1)
+}
+
+//Dec nop
+func (g Gauge) Dec() {
+	g.s.add(-1)
+}
+
+//Add nop
+func (g Gauge) Add(v float64) {
+	g.s.add(v)
+}
+
+//Set nop
+func (g Gauge) Set(v float64) {
+	g.s.set(v)
+}
+
+//Value nop
+func (g Gauge) Value() float64 {
+	return g.s.value()
+}
+
+//CounterVec counters partitioned by labels
+type CounterVec struct {
+	f *family
+}
+
+//With the counter of the label values, in the order of the label names
+func (v CounterVec) With(labelValues ...string) Counter {
+	return Counter{v.f.with(labelValues)}
+}
+
+//GaugeVec gauges partitioned by labels
+type GaugeVec struct {
+	f *family
+}
+
+//With the gauge of the label values, in the order of the label names
+func (v GaugeVec) With(labelValues ...string) Gauge {
+	return Gauge{v.f.with(labelValues)}
+}
+
+//NewCounter nop
+func NewCounter(name, help string) Counter {
+	return Counter{DefaultRegistry.register(name, help, typeCounter, nil).with(nil)}
+}
+
+//NewCounterVec nop
+func NewCounterVec(name, help string, labelNames ...string) CounterVec {
+	return CounterVec{DefaultRegistry.register(name, help, typeCounter, labelNames)}
+}
+
+//NewGauge nop
+func NewGauge(name, help string) Gauge {
+	return Gauge{DefaultRegistry.register(name, help, typeGauge, nil).with(nil)}
+}
+
+//NewGaugeVec nop
+func NewGaugeVec(name, help string, labelNames ...string) GaugeVec {
+	return GaugeVec{DefaultRegistry.register(name, help, typeGauge, labelNames)}
+}
+
+//NewGaugeFunc a gauge whose value is read from fn when written
+func NewGaugeFunc(name, help string, fn func() float64) {
+	f := DefaultRegistry.register(name, help, typeGauge, nil)
+	f.fn = fn
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+//WriteText write all metrics in the prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mutex.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		bw.WriteString("# HELP " + f.name + " " + helpEscaper.Replace(f.help) + "\n")
+		bw.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+		if f.fn != nil {
+			bw.WriteString(f.name + " " + formatValue(f.fn()) + "\n")
+			continue
+		}
+
+		f.mutex.Lock()
+		all := make([]*series, 0, len(f.series))
+		for _, s := range f.series {
+			all = append(all, s)
+		}
+		f.mutex.Unlock()
+		sort.Slice(all, func(i, j int) bool {
+			return strings.Join(all[i].labelValues, "\xff") < strings.Join(all[j].labelValues, "\xff")
+		})
+
+		for _, s := range all {
+			bw.WriteString(f.name)
+			if len(f.labelNames) > 0 {
+				bw.WriteString("{")
+				for i, name := range f.labelNames {
+					if i > 0 {
+						bw.WriteString(",")
+					}
+					bw.WriteString(name + `="` + labelValueEscaper.Replace(s.labelValues[i]) + `"`)
+				}
+				bw.WriteString("}")
+			}
+			bw.WriteString(" " + formatValue(s.value()) + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+//Handler serve the metrics of the default registry
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		DefaultRegistry.WriteText(w)
+	})
+}
@@ -15,11 +15,47 @@ const (
 	STREAM_NEW  StreamType = 0x00
 	STREAM_DEL  StreamType = 0x01
 	STREAM_DATA StreamType = 0x02
+	//STREAM_REPLY the outcome of a STREAM_NEW, the body is one ReplyCode
+	STREAM_REPLY StreamType = 0x03
+	//STREAM_WINDOW_UPDATE grant more STREAM_DATA to a stream with flow control,
+	//only sent on streams opened with STREAM_NEW_FLOW_CONTROL
+	STREAM_WINDOW_UPDATE StreamType = 0x04
+	//STREAM_FIN the sender will send no more STREAM_DATA but still reads, a
+	//stream ends without STREAM_DEL once both sides sent STREAM_FIN. Only
+	//sent on streams opened with STREAM_NEW_HALF_CLOSE.
+	STREAM_FIN StreamType = 0x05
+	//STREAM_PING a keepalive of the session, StreamID is 0 and the body is
+	//PingLength opaque bytes. Only sent when FEATURE_PING was negotiated.
+	STREAM_PING StreamType = 0x06
+	//STREAM_PONG the answer to a STREAM_PING with the same body
+	STREAM_PONG StreamType = 0x07
+	//STREAM_PADDING ignored by the receiver, StreamID is 0 and the body is any
+	//bytes. Only sent when FEATURE_PADDING was negotiated, see Shaper.
+	STREAM_PADDING StreamType = 0x08
+)
+
+//PingLength the body of STREAM_PING and STREAM_PONG
+const PingLength = 8
+
+//STREAM_NEW flags, a byte following the address of a tcp STREAM_NEW or the
+//only byte of a udp STREAM_NEW, servers without the flags ignore it
+const (
+	//STREAM_NEW_WANT_REPLY the client waits for a STREAM_REPLY
+	STREAM_NEW_WANT_REPLY byte = 0x01
+	//STREAM_NEW_FLOW_CONTROL both directions of the tcp stream use windows, see InitialWindow
+	STREAM_NEW_FLOW_CONTROL byte = 0x02
+	//STREAM_NEW_HALF_CLOSE the tcp stream uses STREAM_FIN, only with STREAM_NEW_FLOW_CONTROL
+	STREAM_NEW_HALF_CLOSE byte = 0x04
 )
 
 type ProtoType byte
 
 //PROTO types
+//
+//A UPD_PROTO stream carries the datagrams of one socks5 UDP ASSOCIATE, the
+//body of each STREAM_DATA is an encoded SOCKS5Address followed by the payload.
+//Stream ids are shared by both proto types, so STREAM_DEL applies to a
+//stream whatever its ProtoType.
 const (
 	TCP_PROTO ProtoType = 0x0
 	UPD_PROTO ProtoType = 0x1
@@ -27,7 +63,7 @@ const (
 
 const (
 	protoTypeMask  byte = 0x01
-	streamTypeMask byte = 0x03
+	streamTypeMask byte = 0x0f
 )
 
 //MessageHead the head of Message
@@ -0,0 +1,27 @@
+package proto
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//ParsePortRange parse "80" or "8000-9000"
+func ParsePortRange(value string) (uint16, uint16, error) {
+	parts := strings.SplitN(value, "-", 2)
+	low, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	high := low
+	if len(parts) == 2 {
+		high, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if low > high {
+		return 0, 0, errors.New("invalid port range:" + value)
+	}
+	return uint16(low), uint16(high), nil
+}
@@ -0,0 +1,33 @@
+package proto
+
+//ReplyCode the outcome of opening a stream
+type ReplyCode byte
+
+//Reply codes
+const (
+	REPLY_SUCCEEDED   ReplyCode = 0x00
+	REPLY_FAILURE     ReplyCode = 0x01
+	REPLY_REFUSED     ReplyCode = 0x02
+	REPLY_UNREACHABLE ReplyCode = 0x03
+	REPLY_DNS_FAILURE ReplyCode = 0x04
+	REPLY_DENIED      ReplyCode = 0x05
+	REPLY_TIMEOUT     ReplyCode = 0x06
+)
+
+func (c ReplyCode) String() string {
+	switch c {
+	case REPLY_SUCCEEDED:
+		return "succeeded"
+	case REPLY_REFUSED:
+		return "connection refused"
+	case REPLY_UNREACHABLE:
+		return "unreachable"
+	case REPLY_DNS_FAILURE:
+		return "dns failure"
+	case REPLY_DENIED:
+		return "denied"
+	case REPLY_TIMEOUT:
+		return "timeout"
+	}
+	return "failure"
+}
@@ -0,0 +1,84 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//ProtocolVersion the version of the multiplexing protocol spoken after the
+//tls handshake, peers without settings are version 0
+const ProtocolVersion byte = 1
+
+//SettingsLength the smallest body of a settings frame: the version and the
+//big endian features, longer bodies are accepted so fields can be appended
+const SettingsLength = 5
+
+//Features what a peer of a session supports
+type Features uint32
+
+//Features exchanged in the settings, only the features both peers sent are used
+const (
+	//FEATURE_STREAM_REPLY STREAM_NEW_WANT_REPLY is answered with STREAM_REPLY
+	FEATURE_STREAM_REPLY Features = 1 << iota
+	//FEATURE_FLOW_CONTROL STREAM_NEW_FLOW_CONTROL and STREAM_WINDOW_UPDATE
+	FEATURE_FLOW_CONTROL
+	//FEATURE_HALF_CLOSE STREAM_NEW_HALF_CLOSE and STREAM_FIN
+	FEATURE_HALF_CLOSE
+	//FEATURE_UDP UPD_PROTO streams
+	FEATURE_UDP
+	//FEATURE_PING STREAM_PING is answered with STREAM_PONG
+	FEATURE_PING
+	//FEATURE_PADDING STREAM_PADDING is ignored, a client sends it to have the
+	//session shaped in both directions
+	FEATURE_PADDING
+	//FEATURE_COMPRESSION reserved for compressed STREAM_DATA
+	FEATURE_COMPRESSION
+)
+
+//Settings the first frame a client sends on a session, the server answers
+//with its own. It is a STREAM_DEL of StreamID 0 with a body, which servers
+//without settings ignore, so the client falls back to the legacy protocol
+//when no answer arrives.
+type Settings struct {
+	Version  byte
+	Features Features
+}
+
+//IsSettings whether head is a settings frame
+func IsSettings(head *MessageHead) bool {
+	return head.StreamType == STREAM_DEL && head.StreamID == 0 && head.BodyLength > 0
+}
+
+//Has nop
+func (s Settings) Has(f Features) bool {
+	return s.Features&f == f
+}
+
+//Negotiate the settings both peers support
+func (s Settings) Negotiate(peer Settings) Settings {
+	if peer.Version < s.Version {
+		s.Version = peer.Version
+	}
+	s.Features &= peer.Features
+	return s
+}
+
+//Encode Settings to a whole frame
+func (s Settings) Encode() []byte {
+	data := make([]byte, HeadLength+SettingsLength)
+	head := MessageHead{StreamType: STREAM_DEL, ProtoType: TCP_PROTO, StreamID: 0, BodyLength: SettingsLength}
+	head.Encode(data)
+	data[HeadLength] = s.Version
+	binary.BigEndian.PutUint32(data[HeadLength+1:], uint32(s.Features))
+	return data
+}
+
+//Decode the body of a settings frame
+func (s *Settings) Decode(body []byte) error {
+	if len(body) < SettingsLength {
+		return errors.New("settings too short")
+	}
+	s.Version = body[0]
+	s.Features = Features(binary.BigEndian.Uint32(body[1:]))
+	return nil
+}
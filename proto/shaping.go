@@ -0,0 +1,300 @@
+package proto
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+//ShapingPolicy how the first bytes of every stream are written, so the sizes
+//and timing of a handshake relayed in the tunnel do not show through the tls
+//records. Zero values are replaced with the defaults by Normalize.
+type ShapingPolicy struct {
+	//HeadBytes the bytes of STREAM_DATA shaped at the start of each stream
+	HeadBytes int
+	//MinRecord, MaxRecord the range of the random size of every write, small
+	//frames are filled up with STREAM_PADDING, large ones are split
+	MinRecord int
+	MaxRecord int
+	//MaxDelay the most milliseconds waited before each write, -1 to not wait
+	MaxDelay int
+	//FlushDelay the most milliseconds data not filling a record is held back
+	//to be coalesced with the next writes, -1 to write it at once
+	FlushDelay int
+}
+
+//Shaping defaults
+const (
+	DefaultShapingHeadBytes  = 8 * 1024
+	DefaultShapingMinRecord  = 600
+	DefaultShapingMaxRecord  = 1400
+	DefaultShapingMaxDelay   = 10
+	DefaultShapingFlushDelay = 5
+)
+
+//minShapingRecord room for a data frame with a body and a padding frame
+const minShapingRecord = 4 * HeadLength
+
+//Normalize fill in the defaults and keep the records within a message
+func (p ShapingPolicy) Normalize() ShapingPolicy {
+	if p.HeadBytes <= 0 {
+		p.HeadBytes = DefaultShapingHeadBytes
+	}
+	if p.MinRecord <= 0 {
+		p.MinRecord = DefaultShapingMinRecord
+	}
+	if p.MinRecord < minShapingRecord {
+		p.MinRecord = minShapingRecord
+	}
+	if p.MaxRecord <= 0 {
+		p.MaxRecord = DefaultShapingMaxRecord
+	}
+	if p.MaxRecord > MaxMessageSize {
+		p.MaxRecord = MaxMessageSize
+	}
+	if p.MinRecord > p.MaxRecord {
+		p.MinRecord = p.MaxRecord
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = DefaultShapingMaxDelay
+	} else if p.MaxDelay < 0 {
+		p.MaxDelay = 0
+	}
+	if p.FlushDelay == 0 {
+		p.FlushDelay = DefaultShapingFlushDelay
+	} else if p.FlushDelay < 0 {
+		p.FlushDelay = 0
+	}
+	return p
+}
+
+//Shaper shape the STREAM_DATA of one stream, written by its own goroutine and
+//by a timer flushing what was held back, so write has to be safe for both
+type Shaper struct {
+	policy   ShapingPolicy
+	enabled  bool
+	datagram bool
+	write    func(data []byte) error
+
+	mutex sync.Mutex
+	//head of the pending data
+	head MessageHead
+	//pending the bodies held back to be coalesced, whole frames for datagrams
+	pending []byte
+	//record the size of the next record, 0 until it is chosen
+	record  int
+	shaped  int
+	timer   *time.Timer
+	stopped bool
+	err     error
+}
+
+//NewShaper the shaper of a stream, policy nil writes frames unchanged
+func NewShaper(policy *ShapingPolicy, write func(data []byte) error) *Shaper {
+	s := &Shaper{write: write}
+	if policy != nil {
+		s.policy = policy.Normalize()
+		s.enabled = true
+	}
+	return s
+}
+
+//NewDatagramShaper the shaper of a udp stream, every frame is one datagram,
+//so frames are coalesced and padded but never split
+func NewDatagramShaper(policy *ShapingPolicy, write func(data []byte) error) *Shaper {
+	s := NewShaper(policy, write)
+	s.datagram = true
+	return s
+}
+
+//randIntn a random int in [0, n)
+func randIntn(n int) int {
+	if n <= 1 {
+		return 0
+	}
+	var b [4]byte
+	rand.Read(b[:])
+	return int(binary.BigEndian.Uint32(b[:]) % uint32(n))
+}
+
+//Write an encoded STREAM_DATA frame. Until HeadBytes are sent the body is
+//split into records of random size after a random delay, each record is one
+//data frame followed by a padding frame, so it goes out as one tls record.
+//What does not fill a record is held back up to FlushDelay, so consecutive
+//small writes are coalesced into one record.
+func (s *Shaper) Write(frame []byte) error {
+	if !s.enabled {
+		return s.write(frame)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped || s.err != nil {
+		return s.err
+	}
+	if s.shaped >= s.policy.HeadBytes && len(s.pending) == 0 {
+		return s.write(frame)
+	}
+	head := MessageHead{}
+	head.Decode(frame)
+	frame = frame[:HeadLength+int(head.BodyLength)]
+	if s.datagram {
+		if s.record == 0 {
+			s.record = s.nextRecord()
+		}
+		//a datagram not fitting the record goes into the next one
+		if len(s.pending) > 0 && len(s.pending)+len(frame) > s.record {
+			if err := s.writeRecord(len(s.pending)); err != nil {
+				return err
+			}
+		}
+		s.pending = append(s.pending, frame...)
+	} else {
+		s.head = head
+		s.pending = append(s.pending, frame[HeadLength:]...)
+	}
+	return s.drain(false)
+}
+
+//Flush write what was held back, called before the stream is ended
+func (s *Shaper) Flush() error {
+	if !s.enabled {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped || s.err != nil {
+		return s.err
+	}
+	return s.drain(true)
+}
+
+//Stop drop what was held back, nothing is written after the stream ended
+func (s *Shaper) Stop() {
+	if !s.enabled {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopped = true
+	s.pending = nil
+	s.stopTimer()
+}
+
+func (s *Shaper) stopTimer() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+func (s *Shaper) flushTimer() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.timer = nil
+	if s.stopped || s.err != nil {
+		return
+	}
+	s.drain(true)
+}
+
+func (s *Shaper) nextRecord() int {
+	return s.policy.MinRecord + randIntn(s.policy.MaxRecord-s.policy.MinRecord+1)
+}
+
+//drain write the full records of pending, with flush the rest too,
+//otherwise the rest waits for more data or the timer. After HeadBytes
+//pending goes out as it is.
+func (s *Shaper) drain(flush bool) error {
+	for len(s.pending) > 0 {
+		if s.shaped >= s.policy.HeadBytes {
+			return s.writeRest()
+		}
+		if s.record == 0 {
+			s.record = s.nextRecord()
+		}
+		n := len(s.pending)
+		full := n+HeadLength >= s.record
+		if !s.datagram {
+			n = s.record - 2*HeadLength
+			full = len(s.pending) >= n
+			if !full {
+				n = len(s.pending)
+			}
+		}
+		if !full && !flush && s.policy.FlushDelay > 0 {
+			if s.timer == nil {
+				s.timer = time.AfterFunc(time.Duration(s.policy.FlushDelay)*time.Millisecond, s.flushTimer)
+			}
+			return nil
+		}
+		if err := s.writeRecord(n); err != nil {
+			return err
+		}
+	}
+	s.stopTimer()
+	return nil
+}
+
+//writeRest write pending unshaped
+func (s *Shaper) writeRest() error {
+	s.stopTimer()
+	rest := s.pending
+	s.pending = nil
+	if s.datagram {
+		return s.writeErr(rest)
+	}
+	for len(rest) > 0 {
+		n := len(rest)
+		if n > MaxMessageBodySize {
+			n = MaxMessageBodySize
+		}
+		head := s.head
+		head.BodyLength = uint16(n)
+		buffer := make([]byte, HeadLength+n)
+		head.Encode(buffer)
+		copy(buffer[HeadLength:], rest[:n])
+		if err := s.writeErr(buffer); err != nil {
+			return err
+		}
+		rest = rest[n:]
+	}
+	return nil
+}
+
+//writeErr the first error of write is kept and returned by every later call
+func (s *Shaper) writeErr(data []byte) error {
+	if err := s.write(data); err != nil {
+		s.err = err
+		return err
+	}
+	return nil
+}
+
+//writeRecord write n bytes of pending, filled up to the record size with padding
+func (s *Shaper) writeRecord(n int) error {
+	var buffer []byte
+	if s.datagram {
+		buffer = append(make([]byte, 0, s.record), s.pending[:n]...)
+	} else {
+		buffer = make([]byte, HeadLength+n, s.record)
+		data := MessageHead{StreamType: s.head.StreamType, ProtoType: s.head.ProtoType, StreamID: s.head.StreamID,
+			BodyLength: uint16(n)}
+		data.Encode(buffer)
+		copy(buffer[HeadLength:], s.pending[:n])
+	}
+	if used := len(buffer); s.record-used >= HeadLength {
+		buffer = buffer[:s.record]
+		padding := MessageHead{StreamType: STREAM_PADDING, ProtoType: TCP_PROTO, StreamID: 0,
+			BodyLength: uint16(s.record - used - HeadLength)}
+		padding.Encode(buffer[used:])
+	}
+	s.pending = append(s.pending[:0], s.pending[n:]...)
+	s.record = 0
+	s.shaped += n
+
+	if s.policy.MaxDelay > 0 {
+		time.Sleep(time.Duration(randIntn(s.policy.MaxDelay+1)) * time.Millisecond)
+	}
+	return s.writeErr(buffer)
+}
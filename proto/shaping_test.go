@@ -0,0 +1,241 @@
+package proto
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+//shapingTestRecord every record has this size, its data frame carries 90 bytes
+const shapingTestRecord = 100
+
+type shapingTestWriter struct {
+	mutex  sync.Mutex
+	writes [][]byte
+}
+
+func (w *shapingTestWriter) write(data []byte) error {
+	w.mutex.Lock()
+	w.writes = append(w.writes, append([]byte(nil), data...))
+	w.mutex.Unlock()
+	return nil
+}
+
+func (w *shapingTestWriter) get() [][]byte {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.writes
+}
+
+type shapingTestFrame struct {
+	streamType StreamType
+	body       []byte
+}
+
+//shapingTestFrames split a write into its frames
+func shapingTestFrames(t *testing.T, data []byte) []shapingTestFrame {
+	var frames []shapingTestFrame
+	for len(data) > 0 {
+		if len(data) < HeadLength {
+			t.Fatalf("%v bytes after the last frame", len(data))
+		}
+		head := MessageHead{}
+		head.Decode(data)
+		end := HeadLength + int(head.BodyLength)
+		if end > len(data) {
+			t.Fatalf("frame of %v bytes in a write of %v", end, len(data))
+		}
+		frames = append(frames, shapingTestFrame{head.StreamType, data[HeadLength:end]})
+		data = data[end:]
+	}
+	return frames
+}
+
+func shapingTestData(n int) []byte {
+	frame := make([]byte, HeadLength+n)
+	head := MessageHead{StreamType: STREAM_DATA, ProtoType: TCP_PROTO, StreamID: 7, BodyLength: uint16(n)}
+	head.Encode(frame)
+	for i := range frame[HeadLength:] {
+		frame[HeadLength+i] = byte(i)
+	}
+	return frame
+}
+
+func shapingTestPolicy(headBytes, flushDelay int) *ShapingPolicy {
+	return &ShapingPolicy{HeadBytes: headBytes, MinRecord: shapingTestRecord, MaxRecord: shapingTestRecord,
+		MaxDelay: -1, FlushDelay: flushDelay}
+}
+
+func TestShaperSplitAndPad(t *testing.T) {
+	room := shapingTestRecord - 2*HeadLength
+	tests := []struct {
+		name string
+		body int
+		//data the bodies of the data frame of every record
+		data []int
+	}{
+		{"empty", 0, nil},
+		{"one byte", 1, []int{1}},
+		{"one record", room, []int{room}},
+		{"one byte more", room + 1, []int{room, 1}},
+		{"several records", 3*room + 5, []int{room, room, room, 5}},
+	}
+	for _, tt := range tests {
+		w := &shapingTestWriter{}
+		s := NewShaper(shapingTestPolicy(8192, -1), w.write)
+		frame := shapingTestData(tt.body)
+		if err := s.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+		writes := w.get()
+		if len(writes) != len(tt.data) {
+			t.Fatalf("%v: %v writes, want %v", tt.name, len(writes), len(tt.data))
+		}
+		var got []byte
+		for i, data := range writes {
+			if len(data) != shapingTestRecord {
+				t.Errorf("%v write %v: %v bytes", tt.name, i, len(data))
+			}
+			frames := shapingTestFrames(t, data)
+			if len(frames) != 2 || frames[0].streamType != STREAM_DATA || frames[1].streamType != STREAM_PADDING {
+				t.Fatalf("%v write %v: frames %v", tt.name, i, frames)
+			}
+			if len(frames[0].body) != tt.data[i] {
+				t.Errorf("%v write %v: data of %v bytes, want %v", tt.name, i, len(frames[0].body), tt.data[i])
+			}
+			got = append(got, frames[0].body...)
+		}
+		if !bytes.Equal(got, frame[HeadLength:]) {
+			t.Errorf("%v: data changed", tt.name)
+		}
+	}
+}
+
+//after HeadBytes frames go out unchanged
+func TestShaperHeadBytes(t *testing.T) {
+	room := shapingTestRecord - 2*HeadLength
+	w := &shapingTestWriter{}
+	s := NewShaper(shapingTestPolicy(2*room, -1), w.write)
+	frame := shapingTestData(1000)
+	s.Write(frame)
+	next := shapingTestData(10)
+	s.Write(next)
+
+	writes := w.get()
+	if len(writes) != 4 {
+		t.Fatalf("%v writes, want 4", len(writes))
+	}
+	var got []byte
+	for _, data := range writes[:2] {
+		if len(data) != shapingTestRecord {
+			t.Errorf("shaped write of %v bytes", len(data))
+		}
+		got = append(got, shapingTestFrames(t, data)[0].body...)
+	}
+	rest := shapingTestFrames(t, writes[2])
+	if len(rest) != 1 || rest[0].streamType != STREAM_DATA {
+		t.Fatalf("rest %v", rest)
+	}
+	got = append(got, rest[0].body...)
+	if !bytes.Equal(got, frame[HeadLength:]) {
+		t.Error("data changed")
+	}
+	if !bytes.Equal(writes[3], next) {
+		t.Error("frame after HeadBytes changed")
+	}
+}
+
+func TestShaperCoalesce(t *testing.T) {
+	w := &shapingTestWriter{}
+	s := NewShaper(shapingTestPolicy(8192, 20), w.write)
+	s.Write(shapingTestData(10))
+	s.Write(shapingTestData(20))
+	if n := len(w.get()); n != 0 {
+		t.Fatalf("%v writes before the flush delay", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	writes := w.get()
+	if len(writes) != 1 || len(writes[0]) != shapingTestRecord {
+		t.Fatalf("writes %v", writes)
+	}
+	if frames := shapingTestFrames(t, writes[0]); len(frames[0].body) != 30 {
+		t.Errorf("coalesced %v bytes, want 30", len(frames[0].body))
+	}
+
+	//a full record goes out at once, only the rest waits
+	w = &shapingTestWriter{}
+	s = NewShaper(shapingTestPolicy(8192, 60000), w.write)
+	s.Write(shapingTestData(60))
+	s.Write(shapingTestData(60))
+	if writes := w.get(); len(writes) != 1 || len(shapingTestFrames(t, writes[0])[0].body) != 90 {
+		t.Fatalf("full record not written, writes %v", len(writes))
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if writes := w.get(); len(writes) != 2 || len(shapingTestFrames(t, writes[1])[0].body) != 30 {
+		t.Fatalf("flush did not write the rest, writes %v", len(writes))
+	}
+}
+
+func TestShaperStop(t *testing.T) {
+	w := &shapingTestWriter{}
+	s := NewShaper(shapingTestPolicy(8192, 20), w.write)
+	s.Write(shapingTestData(10))
+	s.Stop()
+	s.Write(shapingTestData(10))
+	s.Flush()
+	time.Sleep(60 * time.Millisecond)
+	if n := len(w.get()); n != 0 {
+		t.Errorf("%v writes after stop", n)
+	}
+}
+
+func TestShaperDisabled(t *testing.T) {
+	w := &shapingTestWriter{}
+	s := NewShaper(nil, w.write)
+	for _, n := range []int{0, 1, MaxMessageBodySize} {
+		frame := shapingTestData(n)
+		s.Write(frame)
+		if writes := w.get(); !bytes.Equal(writes[len(writes)-1], frame) {
+			t.Errorf("frame of %v bytes changed", n)
+		}
+	}
+}
+
+func TestDatagramShaper(t *testing.T) {
+	w := &shapingTestWriter{}
+	s := NewDatagramShaper(shapingTestPolicy(8192, 20), w.write)
+	small := shapingTestData(25)
+	s.Write(small)
+	s.Write(small)
+	s.Write(small)
+	if n := len(w.get()); n != 0 {
+		t.Fatalf("%v writes before the flush delay", n)
+	}
+	//the fourth datagram does not fit, the first three go out padded
+	s.Write(small)
+	writes := w.get()
+	if len(writes) != 1 || len(writes[0]) != shapingTestRecord {
+		t.Fatalf("writes %v", writes)
+	}
+	frames := shapingTestFrames(t, writes[0])
+	if len(frames) != 4 || frames[3].streamType != STREAM_PADDING {
+		t.Fatalf("frames %v", frames)
+	}
+	for _, f := range frames[:3] {
+		if !bytes.Equal(f.body, small[HeadLength:]) {
+			t.Error("datagram changed")
+		}
+	}
+
+	//a datagram larger than a record is neither split nor padded
+	large := shapingTestData(500)
+	s.Flush()
+	s.Write(large)
+	writes = w.get()
+	if !bytes.Equal(writes[len(writes)-1], large) {
+		t.Errorf("large datagram written as %v bytes", len(writes[len(writes)-1]))
+	}
+}
@@ -2,8 +2,8 @@ package proto
 
 import (
 	"errors"
-	"fmt"
 	"net"
+	"strconv"
 )
 
 //AddressType socks5 address type
@@ -23,6 +23,14 @@ type SOCKS5Address struct {
 	Port        uint16
 }
 
+//NewSOCKS5Address convert an ip and port to SOCKS5Address
+func NewSOCKS5Address(ip net.IP, port int) *SOCKS5Address {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &SOCKS5Address{AddressType: IPv4, IP: ip4, Port: uint16(port)}
+	}
+	return &SOCKS5Address{AddressType: IPv6, IP: ip, Port: uint16(port)}
+}
+
 //Encode convert SOCKS5Address to bytes
 func (d *SOCKS5Address) Encode(data []byte) (int, error) {
 
@@ -87,5 +95,5 @@ func (d *SOCKS5Address) String() string {
 	} else {
 		ip = d.FQDN
 	}
-	return fmt.Sprintf("%s:%d", ip, d.Port)
+	return net.JoinHostPort(ip, strconv.Itoa(int(d.Port)))
 }
@@ -0,0 +1,146 @@
+package proto
+
+import "sync"
+
+//InitialWindow the bytes of STREAM_DATA a stream with flow control may
+//receive before the peer grants more with STREAM_WINDOW_UPDATE
+const InitialWindow = 256 * 1024
+
+//WindowUpdateLength the body of a STREAM_WINDOW_UPDATE, a big endian uint32 increment
+const WindowUpdateLength = 4
+
+//SendWindow the bytes a stream may still send
+type SendWindow struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	avail  int64
+	closed bool
+}
+
+//NewSendWindow nop
+func NewSendWindow() *SendWindow {
+	w := &SendWindow{avail: InitialWindow}
+	w.cond = sync.NewCond(&w.mutex)
+	return w
+}
+
+//Take wait until n bytes may be sent, false if the window is closed
+func (w *SendWindow) Take(n int) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for !w.closed && w.avail < int64(n) {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return false
+	}
+	w.avail -= int64(n)
+	return true
+}
+
+//Grant the peer consumed increment bytes
+func (w *SendWindow) Grant(increment uint32) {
+	w.mutex.Lock()
+	w.avail += int64(increment)
+	w.mutex.Unlock()
+	w.cond.Broadcast()
+}
+
+//Close wake up and fail all Take
+func (w *SendWindow) Close() {
+	w.mutex.Lock()
+	w.closed = true
+	w.mutex.Unlock()
+	w.cond.Broadcast()
+}
+
+//RecvWindow the receive side of a stream, the peer may send at most
+//InitialWindow bytes that were not consumed yet
+type RecvWindow struct {
+	mutex    sync.Mutex
+	allowed  int64
+	consumed int64
+}
+
+//NewRecvWindow nop
+func NewRecvWindow() *RecvWindow {
+	return &RecvWindow{allowed: InitialWindow}
+}
+
+//Receive false if the peer sent more than its window
+func (w *RecvWindow) Receive(n int) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if int64(n) > w.allowed {
+		return false
+	}
+	w.allowed -= int64(n)
+	return true
+}
+
+//Consume n received bytes were written out, the increment to send in a
+//STREAM_WINDOW_UPDATE or 0 if it is not worth a frame yet
+func (w *RecvWindow) Consume(n int) uint32 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.consumed += int64(n)
+	if w.consumed < InitialWindow/2 {
+		return 0
+	}
+	increment := w.consumed
+	w.allowed += increment
+	w.consumed = 0
+	return uint32(increment)
+}
+
+//StreamBuffer the received data of a stream waiting to be written out, its
+//size is bounded by the RecvWindow of the stream
+type StreamBuffer struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	closed bool
+}
+
+//NewStreamBuffer nop
+func NewStreamBuffer() *StreamBuffer {
+	b := &StreamBuffer{}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+//Push false if the buffer is closed, data must not be reused by the caller
+func (b *StreamBuffer) Push(data []byte) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return false
+	}
+	b.queue = append(b.queue, data)
+	b.cond.Signal()
+	return true
+}
+
+//Pop wait for data, false once the buffer is closed and drained
+func (b *StreamBuffer) Pop() ([]byte, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for len(b.queue) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if len(b.queue) == 0 {
+		return nil, false
+	}
+	data := b.queue[0]
+	b.queue[0] = nil
+	b.queue = b.queue[1:]
+	return data, true
+}
+
+//Close Pop still returns the data pushed before
+func (b *StreamBuffer) Close() {
+	b.mutex.Lock()
+	b.closed = true
+	b.mutex.Unlock()
+	b.cond.Broadcast()
+}
@@ -0,0 +1,141 @@
+package proto
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSendWindowTake(t *testing.T) {
+	w := NewSendWindow()
+	if !w.Take(InitialWindow - 1) {
+		t.Fatal("take within the window failed")
+	}
+	if !w.Take(1) {
+		t.Fatal("take of the last byte failed")
+	}
+
+	taken := make(chan bool, 1)
+	go func() { taken <- w.Take(100) }()
+	select {
+	case <-taken:
+		t.Fatal("take beyond the window did not wait")
+	case <-time.After(20 * time.Millisecond):
+	}
+	w.Grant(99)
+	select {
+	case <-taken:
+		t.Fatal("take did not wait for the whole grant")
+	case <-time.After(20 * time.Millisecond):
+	}
+	w.Grant(1)
+	select {
+	case ok := <-taken:
+		if !ok {
+			t.Fatal("take after the grant failed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("take not woken by the grant")
+	}
+}
+
+func TestSendWindowClose(t *testing.T) {
+	w := NewSendWindow()
+	w.Take(InitialWindow)
+	taken := make(chan bool, 1)
+	go func() { taken <- w.Take(1) }()
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+	select {
+	case ok := <-taken:
+		if ok {
+			t.Error("take succeeded on a closed window")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("take not woken by close")
+	}
+	w.Grant(InitialWindow)
+	if w.Take(0) {
+		t.Error("take after close succeeded")
+	}
+}
+
+//grants adding up past uint32 do not wrap
+func TestSendWindowOverflow(t *testing.T) {
+	w := NewSendWindow()
+	w.Grant(math.MaxUint32)
+	w.Grant(math.MaxUint32)
+	for i := 0; i < 2; i++ {
+		if !w.Take(math.MaxUint32) {
+			t.Fatal("take of a granted window failed")
+		}
+	}
+	if !w.Take(InitialWindow) {
+		t.Fatal("take of the initial window failed")
+	}
+}
+
+func TestRecvWindow(t *testing.T) {
+	type op struct {
+		receive int
+		consume int
+		want    uint32
+		ok      bool
+	}
+	tests := []struct {
+		name string
+		ops  []op
+	}{
+		{"whole window", []op{{receive: InitialWindow, ok: true}, {receive: 1}}},
+		{"over the window", []op{{receive: InitialWindow + 1}, {receive: InitialWindow, ok: true}}},
+		{"small consume is not granted", []op{
+			{receive: InitialWindow, ok: true},
+			{consume: InitialWindow/2 - 1},
+			{receive: 1}}},
+		{"half consumed is granted", []op{
+			{receive: InitialWindow, ok: true},
+			{consume: InitialWindow/2 - 1},
+			{consume: 1, want: InitialWindow / 2},
+			{receive: InitialWindow / 2, ok: true},
+			{receive: 1}}},
+		{"consumed bytes granted once", []op{
+			{receive: InitialWindow, ok: true},
+			{consume: InitialWindow, want: InitialWindow},
+			{consume: 1},
+			{receive: InitialWindow, ok: true},
+			{receive: 1}}},
+	}
+	for _, tt := range tests {
+		w := NewRecvWindow()
+		for i, o := range tt.ops {
+			if o.consume > 0 {
+				if got := w.Consume(o.consume); got != o.want {
+					t.Errorf("%v op %v: consume = %v, want %v", tt.name, i, got, o.want)
+				}
+				continue
+			}
+			if got := w.Receive(o.receive); got != o.ok {
+				t.Errorf("%v op %v: receive = %v, want %v", tt.name, i, got, o.ok)
+			}
+		}
+	}
+}
+
+func TestStreamBuffer(t *testing.T) {
+	b := NewStreamBuffer()
+	b.Push([]byte("a"))
+	b.Push([]byte("b"))
+	b.Close()
+	if b.Push([]byte("c")) {
+		t.Error("push after close succeeded")
+	}
+	for _, want := range []string{"a", "b"} {
+		data, ok := b.Pop()
+		if !ok || string(data) != want {
+			t.Errorf("pop = %q %v, want %q", data, ok, want)
+		}
+	}
+	if _, ok := b.Pop(); ok {
+		t.Error("pop of a drained closed buffer succeeded")
+	}
+}
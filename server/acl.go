@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ptrbug/invis/proto"
+)
+
+type aclAction string
+
+//acl actions
+const (
+	aclAllow aclAction = "allow"
+	aclDeny  aclAction = "deny"
+)
+
+//acl rule types
+const (
+	aclDomain       = "domain"
+	aclDomainSuffix = "domain-suffix"
+	aclIPCIDR       = "ip-cidr"
+	aclPort         = "port"
+)
+
+//privateCIDRs loopback, link-local and private destinations, denied unless a rule allows them
+var privateCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+var privateNets []*net.IPNet
+
+func init() {
+	for _, v := range privateCIDRs {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			panic(err)
+		}
+		privateNets = append(privateNets, ipNet)
+	}
+}
+
+//aclDeniedError a destination rejected by the acl
+type aclDeniedError struct {
+	reason string
+}
+
+func (e *aclDeniedError) Error() string {
+	return e.reason
+}
+
+type aclRule struct {
+	Type   string
+	Value  string
+	Action aclAction
+}
+
+type aclMatcher struct {
+	aclRule
+	match func(domain string, ip net.IP, port uint16) bool
+}
+
+//destACL decide which destinations a client may reach, the first matched rule wins
+type destACL struct {
+	rules []*aclMatcher
+}
+
+func newDestACL(rules []aclRule) (*destACL, error) {
+	acl := &destACL{}
+	for _, v := range rules {
+		rule, err := newACLMatcher(v)
+		if err != nil {
+			return nil, fmt.Errorf("acl rule %s %s: %v", v.Type, v.Value, err)
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	return acl, nil
+}
+
+func newACLMatcher(cfg aclRule) (*aclMatcher, error) {
+	switch cfg.Action {
+	case aclAllow, aclDeny:
+	default:
+		return nil, fmt.Errorf("unknown acl action:%v", cfg.Action)
+	}
+	rule := &aclMatcher{aclRule: cfg}
+	value := strings.ToLower(strings.TrimSuffix(cfg.Value, "."))
+
+	switch cfg.Type {
+	case aclDomain:
+		rule.match = func(domain string, ip net.IP, port uint16) bool {
+			return domain == value
+		}
+	case aclDomainSuffix:
+		value = strings.TrimPrefix(value, ".")
+		rule.match = func(domain string, ip net.IP, port uint16) bool {
+			return domain == value || strings.HasSuffix(domain, "."+value)
+		}
+	case aclIPCIDR:
+		_, ipNet, err := net.ParseCIDR(cfg.Value)
+		if err != nil {
+			return nil, err
+		}
+		rule.match = func(domain string, ip net.IP, port uint16) bool {
+			return ipNet.Contains(ip)
+		}
+	case aclPort:
+		low, high, err := proto.ParsePortRange(cfg.Value)
+		if err != nil {
+			return nil, err
+		}
+		rule.match = func(domain string, ip net.IP, port uint16) bool {
+			return port >= low && port <= high
+		}
+	default:
+		return nil, fmt.Errorf("unknown acl rule type:%v", cfg.Type)
+	}
+	return rule, nil
+}
+
+//allow check the destination ip, domain is the name ip was resolved from or empty
+func (acl *destACL) allow(domain string, ip net.IP, port uint16) (bool, string) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if acl != nil {
+		for _, rule := range acl.rules {
+			if rule.match(domain, ip, port) {
+				return rule.Action == aclAllow, fmt.Sprintf("rule %s %s", rule.Type, rule.Value)
+			}
+		}
+	}
+	for _, ipNet := range privateNets {
+		if ipNet.Contains(ip) {
+			return false, "private address"
+		}
+	}
+	return true, ""
+}
+
+//resolve the allowed ips of address, in the order they should be dialed
+func (acl *destACL) resolve(address *proto.SOCKS5Address) ([]net.IP, error) {
+	var domain string
+	var ips []net.IP
+	if address.AddressType == proto.DOMAINNAME {
+		if ip := net.ParseIP(address.FQDN); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			domain = address.FQDN
+			var err error
+			ips, err = net.LookupIP(domain)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		ips = []net.IP{address.IP}
+	}
+
+	allowed := ips[:0:0]
+	var reason string
+	for _, ip := range ips {
+		ok, why := acl.allow(domain, ip, address.Port)
+		if ok {
+			allowed = append(allowed, ip)
+		} else {
+			reason = fmt.Sprintf("%v denied by %s", ip, why)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, &aclDeniedError{reason: reason}
+	}
+	return allowed, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ptrbug/invis/metrics"
+	"github.com/ptrbug/invis/proto"
+)
+
+//adminConfig the admin http api, ListenAddr is a loopback address like
+//127.0.0.1:9090 or a unix socket like unix:/var/run/invis.sock
+type adminConfig struct {
+	ListenAddr string
+	Token      string
+}
+
+type adminStream struct {
+	ID        uint16
+	Proto     string
+	Address   string
+	Uptime    int64
+	BytesUp   uint64
+	BytesDown uint64
+}
+
+type adminSession struct {
+	ID         uint64
+	Client     string
+	RemoteAddr string
+	Version    byte
+	Features   proto.Features
+	Uptime     int64
+	BytesIn    uint64
+	BytesOut   uint64
+	Streams    []adminStream
+}
+
+type adminClient struct {
+	ID       string
+	Sessions int
+	Used     uint64
+	Config   clientInfo
+}
+
+type adminServer struct {
+	token      string
+	configPath string
+	registry   *clientRegistry
+}
+
+//listenLocal only loopback addresses and unix sockets are allowed, for admin and metrics
+func listenLocal(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		os.Remove(path)
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		os.Chmod(path, 0600)
+		return ln, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("listen address %v is not loopback", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func runAdminServ(cfg adminConfig, configPath string, registry *clientRegistry) error {
+	if cfg.Token == "" {
+		return errors.New("admin token is required")
+	}
+	ln, err := listenLocal(cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	admin := &adminServer{token: cfg.Token, configPath: configPath, registry: registry}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/clients", admin.handleClients)
+	mux.HandleFunc("/api/clients/", admin.handleClients)
+	mux.HandleFunc("/api/sessions", admin.handleSessions)
+	mux.HandleFunc("/api/sessions/", admin.handleSessions)
+	mux.Handle("/metrics", metrics.Handler())
+	go http.Serve(ln, admin.auth(mux))
+	return nil
+}
+
+func (admin *adminServer) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(admin.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+//pathParts the parts of the path after prefix
+func pathParts(path, prefix string) []string {
+	path = strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func (admin *adminServer) handleClients(w http.ResponseWriter, r *http.Request) {
+	parts := pathParts(r.URL.Path, "/api/clients")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 0:
+		table := admin.registry.get()
+		clients := make([]adminClient, 0, len(table.clients))
+		for id, c := range table.clients {
+			clients = append(clients, adminClient{ID: id.String(),
+				Sessions: len(c.sessionList()),
+				Used:     c.cfg.limit.used(),
+				Config:   c.info,
+			})
+		}
+		sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+		writeJSON(w, clients)
+
+	case r.Method == http.MethodPost && len(parts) == 0:
+		info := clientInfo{}
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := admin.registry.addClient(admin.configPath, info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Printf("admin add client %v\n", info.ID)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete && len(parts) == 1:
+		id, err := uuid.Parse(parts[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := admin.registry.removeClient(admin.configPath, id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		fmt.Printf("admin remove client %v\n", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (admin *adminServer) findSession(id uint64) *Session {
+	for _, c := range admin.registry.get().clients {
+		for _, sess := range c.sessionList() {
+			if sess.id == id {
+				return sess
+			}
+		}
+	}
+	return nil
+}
+
+func newAdminSession(sess *Session, now time.Time) adminSession {
+	settings := sess.getSettings()
+	s := adminSession{ID: sess.id,
+		Client:     sess.cfg.uuid.String(),
+		RemoteAddr: sess.client.RemoteAddr().String(),
+		Version:    settings.Version,
+		Features:   settings.Features,
+		Uptime:     int64(now.Sub(sess.tmStart).Seconds()),
+		BytesIn:    atomic.LoadUint64(&sess.bytesIn),
+		BytesOut:   atomic.LoadUint64(&sess.bytesOut),
+		Streams:    []adminStream{},
+	}
+	for id, remote := range sess.streamList() {
+		st := remote.stats()
+		s.Streams = append(s.Streams, adminStream{ID: id,
+			Proto:     st.proto,
+			Address:   st.address,
+			Uptime:    int64(now.Sub(st.tmStart).Seconds()),
+			BytesUp:   atomic.LoadUint64(&st.bytesUp),
+			BytesDown: atomic.LoadUint64(&st.bytesDown),
+		})
+	}
+	sort.Slice(s.Streams, func(i, j int) bool { return s.Streams[i].ID < s.Streams[j].ID })
+	return s
+}
+
+func (admin *adminServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	parts := pathParts(r.URL.Path, "/api/sessions")
+	if r.Method == http.MethodGet && len(parts) == 0 {
+		client := r.URL.Query().Get("client")
+		now := time.Now()
+		sessions := []adminSession{}
+		for id, c := range admin.registry.get().clients {
+			if client != "" && client != id.String() {
+				continue
+			}
+			for _, sess := range c.sessionList() {
+				sessions = append(sessions, newAdminSession(sess, now))
+			}
+		}
+		sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+		writeJSON(w, sessions)
+		return
+	}
+
+	if r.Method != http.MethodDelete || (len(parts) != 1 && (len(parts) != 3 || parts[1] != "streams")) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sess := admin.findSession(id)
+	if sess == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 {
+		sess.client.Close()
+		fmt.Printf("admin kill client %v session %v\n", sess.cfg.uuid, id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	streamID, err := strconv.ParseUint(parts[2], 10, 16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	remote, ok := sess.getStream(uint16(streamID))
+	if !ok {
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	}
+	remote.stop(true)
+	fmt.Printf("admin kill client %v session %v stream %v\n", sess.cfg.uuid, id, streamID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ptrbug/invis/metrics"
+	"github.com/ptrbug/invis/proto"
+)
+
+//quota periods
+const (
+	quotaTotal = "total"
+	quotaMonth = "month"
+)
+
+//rateLimiter a token bucket, a caller may take more tokens than there are
+//and then waits until the bucket is refilled
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+//newRateLimiter nil if bytesPerSecond is not positive, nil never waits
+func newRateLimiter(bytesPerSecond int) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := float64(bytesPerSecond)
+	if burst < proto.MaxMessageSize {
+		burst = proto.MaxMessageSize
+	}
+	return &rateLimiter{rate: float64(bytesPerSecond), burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mutex.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+//clientLimit the rate limits and traffic quota of one client, shared by all its sessions
+type clientLimit struct {
+	uuid          uuid.UUID
+	uploadLimit   *rateLimiter
+	downloadLimit *rateLimiter
+	quota         uint64
+	quotaPeriod   string
+	usage         *usageStore
+	bytesUp       metrics.Counter
+	bytesDown     metrics.Counter
+}
+
+func newClientLimit(id uuid.UUID, info *clientInfo, usage *usageStore) (*clientLimit, error) {
+	period := info.QuotaPeriod
+	switch period {
+	case "":
+		period = quotaTotal
+	case quotaTotal, quotaMonth:
+	default:
+		return nil, fmt.Errorf("unknown quota period:%v", period)
+	}
+	return &clientLimit{uuid: id,
+		uploadLimit:   newRateLimiter(info.UploadLimit * 1024),
+		downloadLimit: newRateLimiter(info.DownloadLimit * 1024),
+		quota:         uint64(info.Quota) * 1024 * 1024,
+		quotaPeriod:   period,
+		usage:         usage,
+		bytesUp:       clientBytes.With(id.String(), "up"),
+		bytesDown:     clientBytes.With(id.String(), "down"),
+	}, nil
+}
+
+func (l *clientLimit) period() string {
+	if l.quotaPeriod == quotaMonth {
+		return time.Now().Format("2006-01")
+	}
+	return ""
+}
+
+//upload account and throttle n bytes sent by the client
+func (l *clientLimit) upload(n int) {
+	l.usage.add(l.uuid, l.period(), n)
+	l.bytesUp.Add(float64(n))
+	l.uploadLimit.wait(n)
+}
+
+//download account and throttle n bytes sent to the client
+func (l *clientLimit) download(n int) {
+	l.usage.add(l.uuid, l.period(), n)
+	l.bytesDown.Add(float64(n))
+	l.downloadLimit.wait(n)
+}
+
+//used the bytes transferred in the current quota period
+func (l *clientLimit) used() uint64 {
+	return l.usage.used(l.uuid, l.period())
+}
+
+func (l *clientLimit) exceeded() bool {
+	return l.quota > 0 && l.used() >= l.quota
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/ptrbug/invis/metrics"
+)
+
+var (
+	frontedConns       = metrics.NewCounterVec("invis_fronted_connections_total", "Connections to the fronted port by classification.", "class")
+	tlsHandshakes      = metrics.NewCounterVec("invis_tls_handshakes_total", "Tunnel tls handshakes by result.", "result")
+	streamOpenFailures = metrics.NewCounterVec("invis_stream_open_failures_total", "Streams that could not be opened by reason.", "reason")
+	clientBytes        = metrics.NewCounterVec("invis_client_bytes_total", "Tunnel bytes by client and direction.", "client", "direction")
+	webCertRefreshes   = metrics.NewCounterVec("invis_webcert_refresh_total", "Fake website certificate refreshes by result.", "result")
+)
+
+func registerGauges(registry *clientRegistry) {
+	metrics.NewGaugeFunc("invis_sessions_active", "Active tunnel sessions.", func() float64 {
+		n := 0
+		for _, c := range registry.get().clients {
+			n += len(c.sessionList())
+		}
+		return float64(n)
+	})
+	metrics.NewGaugeFunc("invis_streams_active", "Active streams of all sessions.", func() float64 {
+		n := 0
+		for _, c := range registry.get().clients {
+			for _, sess := range c.sessionList() {
+				n += len(sess.streamList())
+			}
+		}
+		return float64(n)
+	})
+	metrics.NewGaugeFunc("invis_clients", "Configured clients.", func() float64 {
+		return float64(len(registry.get().clients))
+	})
+}
+
+//runMetricsServ serve /metrics on a loopback address or unix socket
+func runMetricsServ(addr string) error {
+	ln, err := listenLocal(addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	go http.Serve(ln, mux)
+	return nil
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ptrbug/invis/crypto"
+	faketls "github.com/ptrbug/invis/tls"
+)
+
+const configCheckInterval = time.Second * 5
+
+//serverClient a configured client, its listener and its sessions
+type serverClient struct {
+	info      clientInfo
+	cfg       *tlsServerConfig
+	tlsConfig *faketls.Config
+	ln        *clientListener
+
+	mutex    sync.Mutex
+	closed   bool
+	sessions map[*Session]struct{}
+}
+
+func (c *serverClient) addSession(sess *Session) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return false
+	}
+	c.sessions[sess] = struct{}{}
+	return true
+}
+
+func (c *serverClient) sessionList() []*Session {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	sessions := make([]*Session, 0, len(c.sessions))
+	for sess := range c.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+func (c *serverClient) removeSession(sess *Session) {
+	c.mutex.Lock()
+	delete(c.sessions, sess)
+	c.mutex.Unlock()
+}
+
+//close stop the listener and terminate all sessions
+func (c *serverClient) close() {
+	c.mutex.Lock()
+	c.closed = true
+	sessions := c.sessions
+	c.sessions = nil
+	c.mutex.Unlock()
+
+	if c.ln != nil && c.ln.getClient() == c {
+		c.ln.ln.Close()
+	}
+	for sess := range sessions {
+		sess.client.Close()
+	}
+}
+
+//clientTable an immutable snapshot of the clients, replaced as a whole on reload
+type clientTable struct {
+	clients  map[uuid.UUID]*serverClient
+	verifier *crypto.HelloTokenVerifier
+}
+
+type clientRegistry struct {
+	channel         uuid.UUID
+	tlsServerMgrCfg *tlsServerMangerConfig
+	usage           *usageStore
+	certDir         string
+
+	mutex sync.Mutex
+	infos []clientInfo
+	table atomic.Value
+}
+
+func newClientRegistry(tlsServerMgrCfg *tlsServerMangerConfig, usage *usageStore, certDir string) *clientRegistry {
+	r := &clientRegistry{channel: tlsServerMgrCfg.channel,
+		tlsServerMgrCfg: tlsServerMgrCfg,
+		usage:           usage,
+		certDir:         certDir,
+	}
+	r.table.Store(&clientTable{clients: map[uuid.UUID]*serverClient{},
+		verifier: crypto.NewHelloTokenVerifier(r.channel[:], nil)})
+	return r
+}
+
+func (r *clientRegistry) get() *clientTable {
+	return r.table.Load().(*clientTable)
+}
+
+func (r *clientRegistry) newTLSServerConfig(info *clientInfo) (*tlsServerConfig, error) {
+	id, err := uuid.Parse(info.ID)
+	if err != nil {
+		return nil, fmt.Errorf("client uuid:%v parse error", info.ID)
+	}
+	cert, err := crypto.LoadOrCreateKeyPair(r.certDir, id[:], info.KeyType)
+	if err != nil {
+		return nil, fmt.Errorf("create key pair:%v error %v", id, err)
+	}
+	acl, err := newDestACL(info.ACL)
+	if err != nil {
+		return nil, fmt.Errorf("client uuid:%v %v", id, err)
+	}
+	limit, err := newClientLimit(id, info, r.usage)
+	if err != nil {
+		return nil, fmt.Errorf("client uuid:%v %v", id, err)
+	}
+
+	cfg := &tlsServerConfig{}
+	cfg.uuid = id
+	cfg.cert = cert
+	cfg.listenAddr = info.ListenAddr
+	cfg.acl = acl
+	cfg.limit = limit
+	return cfg, nil
+}
+
+//clientListener the ListenAddr of a client, a restarted client with the same
+//ListenAddr takes it over, so the address is never unbound
+type clientListener struct {
+	addr string
+	ln   net.Listener
+
+	mutex  sync.Mutex
+	client *serverClient
+}
+
+func (l *clientListener) getClient() *serverClient {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.client
+}
+
+func (l *clientListener) setClient(client *serverClient) {
+	l.mutex.Lock()
+	l.client = client
+	l.mutex.Unlock()
+}
+
+//serve hand every connection to the current client until the listener is closed
+func (l *clientListener) serve() {
+	defer l.ln.Close()
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				fmt.Println(err)
+				continue
+			}
+			return
+		}
+		client := l.getClient()
+		go handleSSLConn(faketls.Server(conn, client.tlsConfig), client)
+	}
+}
+
+//apply make infos the current clients. new clients are started, removed ones are
+//stopped and their sessions terminated, a changed client is restarted. nothing
+//changes if any client is invalid or can not listen
+func (r *clientRegistry) apply(infos []clientInfo) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.applyLocked(infos)
+}
+
+func (r *clientRegistry) applyLocked(infos []clientInfo) error {
+	old := r.get().clients
+	clients := make(map[uuid.UUID]*serverClient, len(infos))
+	var added []*serverClient
+	for _, info := range infos {
+		id, err := uuid.Parse(info.ID)
+		if err != nil {
+			return fmt.Errorf("client uuid:%v parse error", info.ID)
+		}
+		if _, ok := clients[id]; ok {
+			return fmt.Errorf("client uuid:%v duplicated", id)
+		}
+		if c, ok := old[id]; ok && reflect.DeepEqual(c.info, info) {
+			clients[id] = c
+			continue
+		}
+		cfg, err := r.newTLSServerConfig(&info)
+		if err != nil {
+			return err
+		}
+		c := &serverClient{info: info, cfg: cfg, sessions: make(map[*Session]struct{})}
+		c.tlsConfig = &faketls.Config{Certificates: []faketls.Certificate{cfg.cert},
+			GetFakeCertificate: r.tlsServerMgrCfg.getFakeCertificate, MaxVersion: r.tlsServerMgrCfg.maxVersion}
+		clients[id] = c
+		added = append(added, c)
+	}
+
+	//the listeners of stopped clients are taken over, the other addresses are
+	//bound before anything changes
+	stopped := make(map[string]*clientListener)
+	for id, c := range old {
+		if clients[id] != c && c.ln != nil {
+			stopped[c.ln.addr] = c.ln
+		}
+	}
+	var opened []*clientListener
+	for _, c := range added {
+		if c.cfg.listenAddr == "" {
+			continue
+		}
+		if l, ok := stopped[c.cfg.listenAddr]; ok {
+			delete(stopped, c.cfg.listenAddr)
+			c.ln = l
+			continue
+		}
+		ln, err := net.Listen("tcp", c.cfg.listenAddr)
+		if err != nil {
+			for _, l := range opened {
+				l.ln.Close()
+			}
+			return fmt.Errorf("client uuid:%v listen error %v", c.cfg.uuid, err)
+		}
+		c.ln = &clientListener{addr: c.cfg.listenAddr, ln: ln}
+		opened = append(opened, c.ln)
+	}
+
+	for _, c := range added {
+		if c.ln != nil {
+			c.ln.setClient(c)
+		}
+	}
+	for id, c := range old {
+		if clients[id] != c {
+			c.close()
+			fmt.Printf("client %v stopped\n", id)
+		}
+	}
+	for _, l := range opened {
+		go l.serve()
+	}
+	for _, c := range added {
+		fmt.Printf("client %v started\n", c.cfg.uuid)
+	}
+
+	ids := make([]uuid.UUID, 0, len(clients))
+	for id := range clients {
+		ids = append(ids, id)
+	}
+	r.table.Store(&clientTable{clients: clients, verifier: crypto.NewHelloTokenVerifier(r.channel[:], ids)})
+	r.infos = infos
+	return nil
+}
+
+//update change the clients and save them to the Clients of the config file
+func (r *clientRegistry) update(path string, change func(infos []clientInfo) ([]clientInfo, error)) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	infos, err := change(append([]clientInfo(nil), r.infos...))
+	if err != nil {
+		return err
+	}
+	if err := r.applyLocked(infos); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data, err = replaceJSONValue(data, "Clients", infos)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+//replaceJSONValue replace the value of key in the top level object of data, the
+//rest of data is kept as it is. The key is matched like json.Unmarshal does and
+//appended if missing.
+func replaceJSONValue(data []byte, key string, value interface{}) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, errors.New("config is not a json object")
+	}
+	start, end, hasKeys := -1, -1, false
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		hasKeys = true
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		if name, ok := tok.(string); ok && strings.EqualFold(name, key) {
+			end = int(dec.InputOffset())
+			start = end - len(raw)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	closing := bytes.LastIndexByte(data, '}')
+
+	//the value is indented like the line it starts on
+	at := start
+	if at < 0 {
+		at = closing
+	}
+	lineStart := bytes.LastIndexByte(data[:at], '\n') + 1
+	indent := data[lineStart:at]
+	indent = indent[:len(indent)-len(bytes.TrimLeft(indent, " \t"))]
+	if start < 0 {
+		indent = []byte("\t")
+	}
+	encoded, err := json.MarshalIndent(value, string(indent), "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	out := &bytes.Buffer{}
+	if start >= 0 {
+		out.Write(data[:start])
+		out.Write(encoded)
+		out.Write(data[end:])
+		return out.Bytes(), nil
+	}
+	head := bytes.TrimRight(data[:closing], " \t\r\n")
+	out.Write(head)
+	if hasKeys {
+		out.WriteString(",")
+	}
+	fmt.Fprintf(out, "\n\t%q: %s\n", key, encoded)
+	out.Write(data[closing:])
+	return out.Bytes(), nil
+}
+
+//addClient add info or replace the client with the same uuid
+func (r *clientRegistry) addClient(path string, info clientInfo) error {
+	id, err := uuid.Parse(info.ID)
+	if err != nil {
+		return fmt.Errorf("client uuid:%v parse error", info.ID)
+	}
+	return r.update(path, func(infos []clientInfo) ([]clientInfo, error) {
+		for i := range infos {
+			if other, err := uuid.Parse(infos[i].ID); err == nil && other == id {
+				infos[i] = info
+				return infos, nil
+			}
+		}
+		return append(infos, info), nil
+	})
+}
+
+func (r *clientRegistry) removeClient(path string, id uuid.UUID) error {
+	return r.update(path, func(infos []clientInfo) ([]clientInfo, error) {
+		for i := range infos {
+			if other, err := uuid.Parse(infos[i].ID); err == nil && other == id {
+				return append(infos[:i], infos[i+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("client uuid:%v not found", id)
+	})
+}
+
+func (r *clientRegistry) reload(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Println("config.json reading error", err)
+		return
+	}
+	appcfg := appConfig{}
+	if err := json.Unmarshal(data, &appcfg); err != nil {
+		fmt.Println("Unmarshal config.json file error", err)
+		return
+	}
+	if err := r.apply(appcfg.Clients); err != nil {
+		fmt.Println("reload clients error", err)
+	}
+}
+
+//watch reload the clients when the config file changes or on SIGHUP
+func (r *clientRegistry) watch(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+	for {
+		select {
+		case <-hup:
+			r.reload(path)
+		case <-time.After(configCheckInterval):
+			fi, err := os.Stat(path)
+			if err != nil || fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+			r.reload(path)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestReplaceJSONValue(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"replace keeps the rest",
+			"{\n  \"FakeWebURL\" : \"https://break.com/\",\n  \"Clients\" : [{\"ID\": \"a\"}],\n  \"Channel\": \"c\"\n}\n",
+			"{\n  \"FakeWebURL\" : \"https://break.com/\",\n  \"Clients\" : [\n  \t{\n  \t\t\"ID\": \"b\"\n  \t}\n  ],\n  \"Channel\": \"c\"\n}\n"},
+		{"key matched without case",
+			"{\"clients\":null}",
+			"{\"clients\":[\n\t{\n\t\t\"ID\": \"b\"\n\t}\n]}"},
+		{"missing key appended",
+			"{\n\t\"Channel\": \"c\"\n}\n",
+			"{\n\t\"Channel\": \"c\",\n\t\"Clients\": [\n\t\t{\n\t\t\t\"ID\": \"b\"\n\t\t}\n\t]\n}\n"},
+		{"empty object",
+			"{}",
+			"{\n\t\"Clients\": [\n\t\t{\n\t\t\t\"ID\": \"b\"\n\t\t}\n\t]\n}"},
+	}
+	value := []struct{ ID string }{{"b"}}
+	for _, tt := range tests {
+		got, err := replaceJSONValue([]byte(tt.data), "Clients", value)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%v:\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+		if !json.Valid(got) {
+			t.Errorf("%v: invalid json %s", tt.name, got)
+		}
+	}
+}
+
+func TestReplaceJSONValueInvalid(t *testing.T) {
+	for _, data := range []string{"", "[]", "{\"Clients\": [", "{\"a\": 1"} {
+		if _, err := replaceJSONValue([]byte(data), "Clients", nil); err == nil {
+			t.Errorf("%q accepted", data)
+		}
+	}
+}
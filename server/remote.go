@@ -1,31 +1,67 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/ptrbug/invis/proto"
 )
 
+//remoteDialTimeout limit connecting one address of the destination
+const remoteDialTimeout = time.Second * 10
+
+//remoteDialBudget limit connecting all addresses of the destination, the
+//reply has to reach the client within the 30 seconds it waits for it
+const remoteDialBudget = time.Second * 20
+
 //Remote nop
 type Remote struct {
+	streamStats
 	sess     *Session
 	toStopCh chan bool
 	die      chan struct{}
 	msgQueue chan []byte
 	msgCache [][]byte
 
-	mutex    sync.Mutex
-	isStoped bool
-	server   net.Conn
+	//nil without flow control, then msgQueue is used
+	sendWindow *proto.SendWindow
+	recvWindow *proto.RecvWindow
+	recvBuffer *proto.StreamBuffer
+	halfClose  bool
+	shaper     *proto.Shaper
+
+	mutex       sync.Mutex
+	isStoped    bool
+	server      net.Conn
+	finReceived bool
+	readDone    bool
+	writeDone   bool
 }
 
-func newRemote(sess *Session) *Remote {
-	return &Remote{sess: sess,
+func newRemote(sess *Session, address *proto.SOCKS5Address, flowControl, halfClose bool) *Remote {
+	remote := &Remote{streamStats: newStreamStats("tcp", address.String()),
+		sess:     sess,
 		toStopCh: make(chan bool, 1),
 		die:      make(chan struct{}),
 		msgQueue: make(chan []byte, 8),
 		msgCache: make([][]byte, 0, 8)}
+	if flowControl {
+		remote.sendWindow = proto.NewSendWindow()
+		remote.recvWindow = proto.NewRecvWindow()
+		remote.recvBuffer = proto.NewStreamBuffer()
+		remote.halfClose = halfClose
+	}
+	return remote
+}
+
+func (remote *Remote) stats() *streamStats {
+	return &remote.streamStats
 }
 
 func (remote *Remote) stop(isServerClose bool) {
@@ -35,24 +71,153 @@ func (remote *Remote) stop(isServerClose bool) {
 	}
 }
 
+//send never blocks the session with flow control, the client may only
+//send what fits into the window
 func (remote *Remote) send(data []byte) {
+	if remote.recvBuffer != nil {
+		if !remote.recvWindow.Receive(len(data)) {
+			fmt.Printf("client %v stream to %v exceeded its window\n", remote.sess.cfg.uuid, remote.address)
+			remote.stop(true)
+			return
+		}
+		remote.recvBuffer.Push(data)
+		return
+	}
 	select {
 	case remote.msgQueue <- data:
 	case <-remote.die:
 	}
 }
 
-func (remote *Remote) agent(StreamID uint16, address string) {
+func (remote *Remote) windowUpdate(increment uint32) {
+	if remote.sendWindow != nil {
+		remote.sendWindow.Grant(increment)
+	}
+}
+
+//finish the client sent STREAM_FIN, the write side of the connection is
+//shut down after the buffered data
+func (remote *Remote) finish() {
+	if !remote.halfClose {
+		return
+	}
+	remote.mutex.Lock()
+	remote.finReceived = true
+	remote.mutex.Unlock()
+	remote.recvBuffer.Close()
+}
+
+//closeDirection the stream is done when both directions are
+func (remote *Remote) closeDirection(StreamID uint16, read bool) {
+	remote.mutex.Lock()
+	if read {
+		remote.readDone = true
+	} else {
+		remote.writeDone = true
+	}
+	done := remote.readDone && remote.writeDone && !remote.isStoped
+	remote.mutex.Unlock()
+	if done {
+		remote.stop(false)
+		remote.sess.remoteStreamDone(StreamID, remote)
+	}
+}
+
+//writeBuffered write the data of a stream with flow control and grant the
+//client what was written
+func (remote *Remote) writeBuffered(StreamID uint16, server net.Conn) {
+	for {
+		data, ok := remote.recvBuffer.Pop()
+		if !ok {
+			remote.mutex.Lock()
+			finReceived := remote.finReceived && !remote.isStoped
+			remote.mutex.Unlock()
+			if finReceived {
+				if tcpConn, ok := server.(*net.TCPConn); ok {
+					tcpConn.CloseWrite()
+				}
+				remote.closeDirection(StreamID, false)
+			}
+			return
+		}
+		remote.sess.cfg.limit.upload(len(data))
+		remote.addUp(len(data))
+		_, err := server.Write(data)
+		if err != nil {
+			remote.stop(true)
+			return
+		}
+		if increment := remote.recvWindow.Consume(len(data)); increment > 0 {
+			remote.sess.writeWindowUpdate(StreamID, increment)
+		}
+	}
+}
+
+func (remote *Remote) dial(StreamID uint16, address *proto.SOCKS5Address) (net.Conn, error) {
+	ips, err := remote.sess.cfg.acl.resolve(address)
+	if err != nil {
+		if _, ok := err.(*aclDeniedError); ok {
+			fmt.Printf("client %v stream %v to %v rejected, %v\n", remote.sess.cfg.uuid, StreamID, address, err)
+			streamOpenFailures.With("acl").Inc()
+		} else {
+			streamOpenFailures.With("resolve").Inc()
+		}
+		return nil, err
+	}
+	port := strconv.Itoa(int(address.Port))
+	dialer := net.Dialer{Timeout: remoteDialTimeout, Deadline: time.Now().Add(remoteDialBudget)}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.Dial("tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if !time.Now().Before(dialer.Deadline) {
+			break
+		}
+	}
+	streamOpenFailures.With("dial").Inc()
+	return nil, err
+}
+
+//replyCode the reply to a client for a failed dial
+func replyCode(err error) proto.ReplyCode {
+	if _, ok := err.(*aclDeniedError); ok {
+		return proto.REPLY_DENIED
+	}
+	if _, ok := err.(*net.DNSError); ok {
+		return proto.REPLY_DNS_FAILURE
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return proto.REPLY_TIMEOUT
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return proto.REPLY_REFUSED
+	}
+	if errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) {
+		return proto.REPLY_UNREACHABLE
+	}
+	return proto.REPLY_FAILURE
+}
+
+func (remote *Remote) agent(StreamID uint16, address *proto.SOCKS5Address, wantReply bool) {
 
 	connected := make(chan net.Conn, 1)
+	remote.shaper = remote.sess.newShaper()
 
 	go func() {
 
 		isServerClose := <-remote.toStopCh
 		if isServerClose {
-			remote.sess.remoteStreamDel(StreamID)
+			remote.shaper.Flush()
+			remote.sess.remoteStreamDel(StreamID, remote)
 		}
+		remote.shaper.Stop()
 		close(remote.die)
+		if remote.recvBuffer != nil {
+			remote.sendWindow.Close()
+			remote.recvBuffer.Close()
+		}
 
 		remote.mutex.Lock()
 		remote.isStoped = true
@@ -64,44 +229,77 @@ func (remote *Remote) agent(StreamID uint16, address string) {
 	}()
 
 	go func() {
-		conn, err := net.Dial("tcp", address)
+		conn, err := remote.dial(StreamID, address)
 		if err != nil {
+			if wantReply {
+				remote.sess.writeStreamReply(StreamID, replyCode(err))
+			}
 			remote.stop(true)
 			return
 		}
 
+		//stop closes the connection, also once both directions of a half closed stream ended
 		remote.mutex.Lock()
 		if remote.isStoped {
 			conn.Close()
 			remote.mutex.Unlock()
 			return
 		}
+		remote.server = conn
 		remote.mutex.Unlock()
 
+		//the reply goes out before any data of the stream
+		if wantReply {
+			remote.sess.writeStreamReply(StreamID, proto.REPLY_SUCCEEDED)
+		}
+
 		connected <- conn
 		var buffer [proto.MaxMessageSize]byte
 		for {
 			n, err := conn.Read(buffer[proto.HeadLength:])
+			if err == io.EOF && remote.halfClose {
+				remote.shaper.Flush()
+				remote.sess.writeStreamFin(StreamID)
+				remote.closeDirection(StreamID, true)
+				return
+			}
 			if err != nil {
 				remote.stop(true)
 				return
 			}
 
+			if remote.sendWindow != nil && !remote.sendWindow.Take(n) {
+				return
+			}
+			remote.sess.cfg.limit.download(n)
+			remote.addDown(n)
+
 			head := proto.MessageHead{}
 			head.StreamType = proto.STREAM_DATA
 			head.ProtoType = proto.TCP_PROTO
 			head.StreamID = StreamID
 			head.BodyLength = uint16(n)
 			head.Encode(buffer[:proto.HeadLength])
-			remote.sess.write(buffer[:proto.HeadLength+int(head.BodyLength)])
+			remote.shaper.Write(buffer[:proto.HeadLength+int(head.BodyLength)])
 		}
 	}()
 
+	if remote.recvBuffer != nil {
+		select {
+		case server := <-connected:
+			remote.writeBuffered(StreamID, server)
+		case <-remote.die:
+		}
+		return
+	}
+
 	var server net.Conn
 	for {
 		select {
 		case data := <-remote.msgQueue:
 			if server != nil {
+				remote.sess.cfg.limit.upload(len(data))
+				remote.addUp(len(data))
 				_, err := server.Write(data)
 				if err != nil {
 					remote.stop(true)
@@ -112,6 +310,8 @@ func (remote *Remote) agent(StreamID uint16, address string) {
 			}
 		case server = <-connected:
 			for _, data := range remote.msgCache {
+				remote.sess.cfg.limit.upload(len(data))
+				remote.addUp(len(data))
 				_, err := server.Write(data)
 				if err != nil {
 					remote.stop(true)
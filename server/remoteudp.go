@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ptrbug/invis/proto"
+)
+
+//udpIdleTimeout a udp stream without datagrams in either direction is closed
+const udpIdleTimeout = time.Second * 60
+
+//maxUDPAddrLength the longest encoded SOCKS5Address of a datagram source
+const maxUDPAddrLength = 19
+
+//udpResolveTTL how long the acl result of a domain destination is reused, so
+//not every datagram of a stream to a domain pays a dns lookup
+const udpResolveTTL = time.Second * 60
+
+//maxUDPResolved the most destinations cached by one udp stream
+const maxUDPResolved = 256
+
+type udpResolved struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+//RemoteUDP relay the datagrams of one udp associate stream
+type RemoteUDP struct {
+	streamStats
+	sess       *Session
+	toStopCh   chan bool
+	die        chan struct{}
+	msgQueue   chan []byte
+	lastActive int64
+	resolved   map[string]*udpResolved
+}
+
+func newRemoteUDP(sess *Session) *RemoteUDP {
+	return &RemoteUDP{streamStats: newStreamStats("udp", ""),
+		sess:     sess,
+		toStopCh: make(chan bool, 1),
+		die:      make(chan struct{}),
+		msgQueue: make(chan []byte, 64),
+		resolved: make(map[string]*udpResolved)}
+}
+
+func (remote *RemoteUDP) stats() *streamStats {
+	return &remote.streamStats
+}
+
+func (remote *RemoteUDP) stop(isServerClose bool) {
+	select {
+	case remote.toStopCh <- isServerClose:
+	default:
+	}
+}
+
+func (remote *RemoteUDP) send(data []byte) {
+	select {
+	case remote.msgQueue <- data:
+	case <-remote.die:
+	default:
+		//queue is full, drop the datagram like a congested link would
+	}
+}
+
+//windowUpdate udp streams have no flow control
+func (remote *RemoteUDP) windowUpdate(increment uint32) {
+}
+
+//finish udp streams have no half close
+func (remote *RemoteUDP) finish() {
+}
+
+func (remote *RemoteUDP) touch() {
+	atomic.StoreInt64(&remote.lastActive, time.Now().UnixNano())
+}
+
+func (remote *RemoteUDP) isIdle() bool {
+	lastActive := time.Unix(0, atomic.LoadInt64(&remote.lastActive))
+	return time.Since(lastActive) >= udpIdleTimeout
+}
+
+//resolve the allowed ips of a destination, the results for domains are cached
+//for udpResolveTTL. Only the agent goroutine calls it.
+func (remote *RemoteUDP) resolve(StreamID uint16, address *proto.SOCKS5Address) ([]net.IP, error) {
+	isDomain := address.AddressType == proto.DOMAINNAME
+	key := address.String()
+	now := time.Now()
+	if r, ok := remote.resolved[key]; ok && isDomain && now.Before(r.expires) {
+		return r.ips, r.err
+	}
+	ips, err := remote.sess.cfg.acl.resolve(address)
+	if _, ok := err.(*aclDeniedError); ok {
+		fmt.Printf("client %v stream %v datagram to %v rejected, %v\n", remote.sess.cfg.uuid, StreamID, address, err)
+	}
+	if !isDomain {
+		return ips, err
+	}
+	if len(remote.resolved) >= maxUDPResolved {
+		remote.resolved = make(map[string]*udpResolved)
+	}
+	remote.resolved[key] = &udpResolved{ips: ips, err: err, expires: now.Add(udpResolveTTL)}
+	return ips, err
+}
+
+func (remote *RemoteUDP) agent(StreamID uint16, wantReply bool) {
+	shaper := remote.sess.newDatagramShaper()
+
+	go func() {
+		isServerClose := <-remote.toStopCh
+		if isServerClose {
+			shaper.Flush()
+			remote.sess.remoteStreamDel(StreamID, remote)
+		}
+		shaper.Stop()
+		close(remote.die)
+	}()
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		if wantReply {
+			remote.sess.writeStreamReply(StreamID, proto.REPLY_FAILURE)
+		}
+		remote.stop(true)
+		return
+	}
+	defer conn.Close()
+	remote.touch()
+	if wantReply {
+		remote.sess.writeStreamReply(StreamID, proto.REPLY_SUCCEEDED)
+	}
+
+	go func() {
+		var buffer [proto.MaxMessageSize]byte
+		payload := buffer[proto.HeadLength+maxUDPAddrLength:]
+		for {
+			conn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+			n, from, err := conn.ReadFromUDP(payload)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() && !remote.isIdle() {
+					continue
+				}
+				remote.stop(true)
+				return
+			}
+			remote.touch()
+			remote.sess.cfg.limit.download(n)
+			remote.addDown(n)
+
+			address := proto.NewSOCKS5Address(from.IP, from.Port)
+			var addrBuf [maxUDPAddrLength]byte
+			addrLen, err := address.Encode(addrBuf[:])
+			if err != nil {
+				continue
+			}
+			start := proto.HeadLength + maxUDPAddrLength - addrLen
+			copy(buffer[start:], addrBuf[:addrLen])
+
+			head := proto.MessageHead{}
+			head.StreamType = proto.STREAM_DATA
+			head.ProtoType = proto.UPD_PROTO
+			head.StreamID = StreamID
+			head.BodyLength = uint16(addrLen + n)
+			head.Encode(buffer[start-proto.HeadLength : start])
+			shaper.Write(buffer[start-proto.HeadLength : start+addrLen+n])
+		}
+	}()
+
+	for {
+		select {
+		case data := <-remote.msgQueue:
+			address := &proto.SOCKS5Address{}
+			n, err := address.Decode(data)
+			if err != nil {
+				continue
+			}
+			ips, err := remote.resolve(StreamID, address)
+			if err != nil {
+				continue
+			}
+			remote.sess.cfg.limit.upload(len(data) - n)
+			remote.addUp(len(data) - n)
+			udpAddr := &net.UDPAddr{IP: ips[0], Port: int(address.Port)}
+			if _, err := conn.WriteToUDP(data[n:], udpAddr); err == nil {
+				remote.touch()
+			}
+		case <-remote.die:
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxClockSkew    = time.Second * 120
+	defaultReplayCacheSize = 100000
+)
+
+type replayEntry struct {
+	key    [28]byte
+	expire time.Time
+}
+
+//replayGuard reject client hello randoms that are too old, too new or already seen.
+//a random is remembered until it falls out of the clock skew window, the oldest
+//ones are forgotten first when the cache is full
+type replayGuard struct {
+	maxClockSkew time.Duration
+	maxEntries   int
+
+	mutex sync.Mutex
+	seen  map[[28]byte]*list.Element
+	order *list.List
+}
+
+func newReplayGuard(maxClockSkew time.Duration, maxEntries int) *replayGuard {
+	if maxClockSkew <= 0 {
+		maxClockSkew = defaultMaxClockSkew
+	}
+	if maxEntries <= 0 {
+		maxEntries = defaultReplayCacheSize
+	}
+	return &replayGuard{maxClockSkew: maxClockSkew,
+		maxEntries: maxEntries,
+		seen:       make(map[[28]byte]*list.Element),
+		order:      list.New(),
+	}
+}
+
+//check true if random encoded at tm is fresh and seen for the first time
+func (g *replayGuard) check(tm time.Time, random []byte) bool {
+	now := time.Now()
+	skew := now.Sub(tm)
+	if skew > g.maxClockSkew || skew < -g.maxClockSkew {
+		return false
+	}
+
+	//the legacy timestamp is not authenticated, changing it must not make a replay look new
+	var key [28]byte
+	copy(key[:], random[4:32])
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for e := g.order.Front(); e != nil; e = g.order.Front() {
+		entry := e.Value.(*replayEntry)
+		if now.Before(entry.expire) && g.order.Len() < g.maxEntries {
+			break
+		}
+		g.order.Remove(e)
+		delete(g.seen, entry.key)
+	}
+
+	if _, ok := g.seen[key]; ok {
+		return false
+	}
+	entry := &replayEntry{key: key, expire: now.Add(g.maxClockSkew * 2)}
+	g.seen[key] = g.order.PushBack(entry)
+	return true
+}
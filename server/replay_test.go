@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func replayTestRandom(b byte) []byte {
+	random := make([]byte, 32)
+	for i := range random {
+		random[i] = b
+	}
+	return random
+}
+
+func TestReplayGuardSkew(t *testing.T) {
+	g := newReplayGuard(time.Minute, 0)
+	now := time.Now()
+	tests := []struct {
+		name string
+		tm   time.Time
+		want bool
+	}{
+		{"now", now, true},
+		{"late within the skew", now.Add(-50 * time.Second), true},
+		{"early within the skew", now.Add(50 * time.Second), true},
+		{"too old", now.Add(-2 * time.Minute), false},
+		{"too new", now.Add(2 * time.Minute), false},
+	}
+	for i, tt := range tests {
+		if got := g.check(tt.tm, replayTestRandom(byte(i))); got != tt.want {
+			t.Errorf("%v: check = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReplayGuardHit(t *testing.T) {
+	g := newReplayGuard(time.Minute, 0)
+	now := time.Now()
+	a := replayTestRandom(1)
+	if !g.check(now, a) {
+		t.Fatal("first hello rejected")
+	}
+	if g.check(now, a) {
+		t.Error("replay accepted")
+	}
+
+	//the legacy timestamp in the first bytes is not part of the key
+	b := append([]byte(nil), a...)
+	b[0] ^= 0xff
+	if g.check(now, b) {
+		t.Error("replay with another legacy timestamp accepted")
+	}
+	if !g.check(now, replayTestRandom(2)) {
+		t.Error("other hello rejected")
+	}
+}
+
+func TestReplayGuardEviction(t *testing.T) {
+	g := newReplayGuard(time.Minute, 2)
+	now := time.Now()
+	for b := byte(1); b <= 3; b++ {
+		if !g.check(now, replayTestRandom(b)) {
+			t.Fatalf("hello %v rejected", b)
+		}
+	}
+	if g.order.Len() != 2 || len(g.seen) != 2 {
+		t.Errorf("%v entries in the list, %v in the map, want 2", g.order.Len(), len(g.seen))
+	}
+	//the oldest was forgotten, the newest are still replays
+	if g.check(now, replayTestRandom(3)) {
+		t.Error("newest replay accepted")
+	}
+	if !g.check(now, replayTestRandom(1)) {
+		t.Error("evicted hello rejected")
+	}
+}
+
+func TestReplayGuardExpiry(t *testing.T) {
+	skew := 20 * time.Millisecond
+	g := newReplayGuard(skew, 0)
+	a := replayTestRandom(1)
+	if !g.check(time.Now(), a) {
+		t.Fatal("first hello rejected")
+	}
+	time.Sleep(3 * skew)
+	//a is expired, checking another hello drops it
+	if !g.check(time.Now(), replayTestRandom(2)) {
+		t.Fatal("second hello rejected")
+	}
+	var key [28]byte
+	copy(key[:], a[4:])
+	if _, ok := g.seen[key]; ok || g.order.Len() != 1 {
+		t.Errorf("expired hello kept, %v entries", g.order.Len())
+	}
+	if !g.check(time.Now(), a) {
+		t.Error("expired hello rejected")
+	}
+}
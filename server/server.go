@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,7 +20,14 @@ import (
 
 type clientInfo struct {
 	ID         string
-	ListenAddr string
+	ListenAddr string    `json:",omitempty"`
+	ACL        []aclRule `json:",omitempty"`
+	KeyType    string    `json:",omitempty"`
+	//UploadLimit, DownloadLimit KB/s, Quota MB, 0 is unlimited
+	UploadLimit   int    `json:",omitempty"`
+	DownloadLimit int    `json:",omitempty"`
+	Quota         int    `json:",omitempty"`
+	QuotaPeriod   string `json:",omitempty"`
 }
 
 type appConfig struct {
@@ -27,19 +35,30 @@ type appConfig struct {
 	FrontedListenAddr string
 	Channel           string
 	Clients           []clientInfo
+	StateFile         string
+	CertCacheDir      string
+	MaxClockSkew      int
+	ReplayCacheSize   int
+	//DisableLegacyHello reject the v1 client hello random once all clients are upgraded
+	DisableLegacyHello bool
+	Admin              adminConfig
+	MetricsListenAddr  string
+	//Shaping how sessions are shaped for the clients asking for it, nil for the defaults
+	Shaping *proto.ShapingPolicy
 }
 
 type tlsServerConfig struct {
 	cert       faketls.Certificate
 	uuid       uuid.UUID
 	listenAddr string
+	acl        *destACL
+	limit      *clientLimit
 }
 
 type tlsServerMangerConfig struct {
 	channel            uuid.UUID
 	maxVersion         uint16
 	getFakeCertificate func() *faketls.Certificate
-	tlsServers         *map[uuid.UUID]*tlsServerConfig
 }
 
 func main() {
@@ -63,25 +82,18 @@ func main() {
 		return
 	}
 
-	tlsServers := make(map[uuid.UUID]*tlsServerConfig, len(appcfg.Clients))
-	for _, v := range appcfg.Clients {
-		uuid, err := uuid.Parse(v.ID)
-		if err != nil {
-			fmt.Printf("client uuid:%v parse error", v.ID)
-			return
-		}
-		cert, err := crypto.CreateX509KeyPair(uuid[:], 2048)
-		if err != nil {
-			fmt.Printf("createX509KeyPair:%v error", uuid)
-			return
-		}
-
-		cfg := &tlsServerConfig{}
-		cfg.uuid = uuid
-		cfg.cert = cert
-		cfg.listenAddr = v.ListenAddr
-		tlsServers[uuid] = cfg
+	if appcfg.CertCacheDir == "" {
+		appcfg.CertCacheDir = "certs"
+	}
+	if appcfg.StateFile == "" {
+		appcfg.StateFile = "state.json"
+	}
+	usage, err := loadUsageStore(appcfg.StateFile)
+	if err != nil {
+		fmt.Println("load state file error", err)
+		return
 	}
+	go usage.saveOnTimer()
 
 	url, err := url.Parse(appcfg.FakeWebURL)
 	if err != nil {
@@ -102,43 +114,43 @@ func main() {
 	tlsServerMgrCfg := &tlsServerMangerConfig{channel: channel,
 		maxVersion:         maxVersion,
 		getFakeCertificate: webCert.getCert,
-		tlsServers:         &tlsServers,
 	}
-	tlsServerAddrs, err := startTLSServ(tlsServerMgrCfg)
+	registry := newClientRegistry(tlsServerMgrCfg, usage, appcfg.CertCacheDir)
+	err = registry.apply(appcfg.Clients)
 	if err != nil {
+		fmt.Println(err)
 		return
 	}
+	go registry.watch("config.json")
 
-	runFrontedServ(appcfg.FrontedListenAddr, webAddr, &channel, tlsServerAddrs)
-}
+	if appcfg.Shaping != nil {
+		serverShaping = appcfg.Shaping
+	}
 
-func startTLSServ(tlsServerMgrCfg *tlsServerMangerConfig) (map[uuid.UUID]string, error) {
+	registerGauges(registry)
+	if appcfg.MetricsListenAddr != "" {
+		err = runMetricsServ(appcfg.MetricsListenAddr)
+		if err != nil {
+			fmt.Println("metrics server error", err)
+			return
+		}
+	}
 
-	tlsServerAddrs := make(map[uuid.UUID]string, len(*tlsServerMgrCfg.tlsServers))
-	for uuid, client := range *tlsServerMgrCfg.tlsServers {
-		config := &faketls.Config{Certificates: []faketls.Certificate{client.cert},
-			GetFakeCertificate: tlsServerMgrCfg.getFakeCertificate, MaxVersion: tlsServerMgrCfg.maxVersion}
-		ln, err := faketls.Listen("tcp", client.listenAddr, config)
+	if appcfg.Admin.ListenAddr != "" {
+		err = runAdminServ(appcfg.Admin, "config.json", registry)
 		if err != nil {
-			fmt.Println(err)
-			return nil, err
+			fmt.Println("admin server error", err)
+			return
 		}
-		tlsServerAddrs[uuid] = client.listenAddr
-
-		go func() {
-			defer ln.Close()
-			for {
-				conn, err := ln.Accept()
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
-				go handleSSLConn(conn)
-			}
-		}()
 	}
 
-	return tlsServerAddrs, nil
+	fronted := &frontedServ{fakeWebAddr: webAddr,
+		channel:     channel,
+		registry:    registry,
+		replay:      newReplayGuard(time.Duration(appcfg.MaxClockSkew)*time.Second, appcfg.ReplayCacheSize),
+		legacyHello: !appcfg.DisableLegacyHello,
+	}
+	runFrontedServ(appcfg.FrontedListenAddr, fronted)
 }
 
 func forwadTCPConn(remoteAddr string, client net.Conn, data []byte) {
@@ -155,7 +167,38 @@ func forwadTCPConn(remoteAddr string, client net.Conn, data []byte) {
 	io.Copy(server, client)
 }
 
-func runFrontedServ(frontedAddr, fakeWebAddr string, channel *uuid.UUID, tlsServerAddrs map[uuid.UUID]string) error {
+//frontedServ decide where a connection to the fronted port goes by its client hello random
+type frontedServ struct {
+	fakeWebAddr string
+	channel     uuid.UUID
+	registry    *clientRegistry
+	replay      *replayGuard
+	legacyHello bool
+}
+
+//identify the client of random, v2 tokens are tried before the legacy format
+func (f *frontedServ) identify(random []byte) (client *serverClient, tm time.Time, ok bool) {
+	table := f.registry.get()
+	clientUUID, tm, ok := table.verifier.Verify(random)
+	if !ok && f.legacyHello {
+		clientUUID = crypto.DecodeHelloRandom(random, f.channel[:])
+		tm = crypto.HelloRandomTime(random)
+	}
+	client, ok = table.clients[clientUUID]
+	return client, tm, ok
+}
+
+//peekedConn a conn whose first bytes were already read, reader returns them again
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func runFrontedServ(frontedAddr string, fronted *frontedServ) error {
 	ln, err := net.Listen("tcp", frontedAddr)
 	if err != nil {
 		fmt.Println(err)
@@ -169,11 +212,11 @@ func runFrontedServ(frontedAddr, fakeWebAddr string, channel *uuid.UUID, tlsServ
 			fmt.Println(err)
 			continue
 		}
-		go handleFrontedConn(conn, fakeWebAddr, channel, tlsServerAddrs)
+		go handleFrontedConn(conn, fronted)
 	}
 }
 
-func handleFrontedConn(conn net.Conn, fakeWebAddr string, channel *uuid.UUID, tlsServerAddrs map[uuid.UUID]string) {
+func handleFrontedConn(conn net.Conn, fronted *frontedServ) {
 
 	var partClientHello [43]byte
 	conn.SetReadDeadline(time.Now().Add(time.Second * 10))
@@ -184,18 +227,28 @@ func handleFrontedConn(conn net.Conn, fakeWebAddr string, channel *uuid.UUID, tl
 	conn.SetDeadline(time.Time{})
 
 	random := partClientHello[11:43]
-	clientUUID := crypto.DecodeHelloRandom(random, channel[:])
-
-	addr, ok := tlsServerAddrs[clientUUID]
+	client, tm, ok := fronted.identify(random)
+	if ok && !fronted.replay.check(tm, random) {
+		//a replayed or stale hello gets the same answer as a browser
+		fmt.Printf("client %v replayed or stale hello from %v\n", client.cfg.uuid, conn.RemoteAddr())
+		frontedConns.With("replay").Inc()
+		ok = false
+	}
 	if ok {
-		go forwadTCPConn(addr, conn, partClientHello[:])
+		frontedConns.With("tunnel").Inc()
+		//the tls server reads the peeked bytes again, no loopback connection is needed
+		peeked := &peekedConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(partClientHello[:]), conn)}
+		go handleSSLConn(faketls.Server(peeked, client.tlsConfig), client)
 
 	} else {
-		go forwadTCPConn(fakeWebAddr, conn, partClientHello[:])
+		if client == nil {
+			frontedConns.With("browser").Inc()
+		}
+		go forwadTCPConn(fronted.fakeWebAddr, conn, partClientHello[:])
 	}
 }
 
-func handleSSLConn(conn net.Conn) {
+func handleSSLConn(conn net.Conn, client *serverClient) {
 	defer conn.Close()
 	header := make([]byte, proto.HeadLength)
 	in := make(chan *proto.Message)
@@ -203,7 +256,21 @@ func handleSSLConn(conn net.Conn) {
 		close(in)
 	}()
 
-	sess := newSession(conn)
+	if tlsConn, ok := conn.(*faketls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(time.Second * 10))
+		if err := tlsConn.Handshake(); err != nil {
+			tlsHandshakes.With("failure").Inc()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		tlsHandshakes.With("success").Inc()
+	}
+
+	sess := newSession(conn, client.cfg)
+	if !client.addSession(sess) {
+		return
+	}
+	defer client.removeSession(sess)
 	go sess.agent(in)
 
 	for {
@@ -214,6 +281,7 @@ func handleSSLConn(conn net.Conn) {
 		message := &proto.Message{}
 		Head := &message.Head
 		Head.Decode(header[:])
+		atomic.AddUint64(&sess.bytesIn, uint64(proto.HeadLength+int(Head.BodyLength)))
 
 		if Head.BodyLength > 0 {
 			if Head.BodyLength > proto.MaxMessageBodySize {
@@ -1,30 +1,96 @@
 package main
 
 import (
+	"encoding/binary"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ptrbug/invis/proto"
 )
 
+type stream interface {
+	send(data []byte)
+	stop(isServerClose bool)
+	stats() *streamStats
+	windowUpdate(increment uint32)
+	finish()
+}
+
+//streamStats what a stream is connected to and the bytes it relayed
+type streamStats struct {
+	bytesUp   uint64
+	bytesDown uint64
+	proto     string
+	address   string
+	tmStart   time.Time
+}
+
+func newStreamStats(proto, address string) streamStats {
+	return streamStats{proto: proto, address: address, tmStart: time.Now()}
+}
+
+func (st *streamStats) addUp(n int) {
+	atomic.AddUint64(&st.bytesUp, uint64(n))
+}
+
+func (st *streamStats) addDown(n int) {
+	atomic.AddUint64(&st.bytesDown, uint64(n))
+}
+
+//streamDone a stream that ended on the server side, the remote tells it apart
+//from a later stream reusing the id
+type streamDone struct {
+	StreamID uint16
+	remote   stream
+}
+
+var sessionSeq uint64
+
+//serverSettings what this server supports, sent in answer to the settings of a client
+var serverSettings = proto.Settings{Version: proto.ProtocolVersion,
+	Features: proto.FEATURE_STREAM_REPLY | proto.FEATURE_FLOW_CONTROL | proto.FEATURE_HALF_CLOSE |
+		proto.FEATURE_UDP | proto.FEATURE_PING | proto.FEATURE_PADDING}
+
+//serverShaping the policy of the sessions that negotiated FEATURE_PADDING
+var serverShaping = &proto.ShapingPolicy{}
+
 //Session nop
 type Session struct {
-	client            net.Conn
-	streams           map[uint16]*Remote
-	remoteStreamDelCh chan uint16
-	clientWriteErrCh  chan error
-	Die               chan struct{}
+	bytesIn            uint64
+	bytesOut           uint64
+	id                 uint64
+	tmStart            time.Time
+	client             net.Conn
+	cfg                *tlsServerConfig
+	streamsMutex       sync.Mutex
+	streams            map[uint16]stream
+	settings           proto.Settings
+	remoteStreamDelCh  chan streamDone
+	remoteStreamDoneCh chan streamDone
+	clientWriteErrCh   chan error
+	Die                chan struct{}
 }
 
-func newSession(client net.Conn) *Session {
+func newSession(client net.Conn, cfg *tlsServerConfig) *Session {
 	return &Session{
-		client:            client,
-		streams:           make(map[uint16]*Remote, 16),
-		remoteStreamDelCh: make(chan uint16, 16),
-		clientWriteErrCh:  make(chan error, 1),
-		Die:               make(chan struct{})}
+		id:                 atomic.AddUint64(&sessionSeq, 1),
+		tmStart:            time.Now(),
+		client:             client,
+		cfg:                cfg,
+		streams:            make(map[uint16]stream, 16),
+		remoteStreamDelCh:  make(chan streamDone, 16),
+		remoteStreamDoneCh: make(chan streamDone, 16),
+		clientWriteErrCh:   make(chan error, 1),
+		Die:                make(chan struct{})}
 }
 
+//write is not throttled, the readers of the streams charge the download limit
+//for the data, so control frames of the agent never wait for it
 func (sess *Session) write(data []byte) {
+	atomic.AddUint64(&sess.bytesOut, uint64(len(data)))
 	_, err := sess.client.Write(data)
 	if err != nil {
 		select {
@@ -35,14 +101,159 @@ func (sess *Session) write(data []byte) {
 	}
 }
 
-func (sess *Session) remoteStreamDel(StreamID uint16) {
+func (sess *Session) setStream(StreamID uint16, remote stream) {
+	sess.streamsMutex.Lock()
+	sess.streams[StreamID] = remote
+	sess.streamsMutex.Unlock()
+}
+
+func (sess *Session) delStream(StreamID uint16) {
+	sess.streamsMutex.Lock()
+	delete(sess.streams, StreamID)
+	sess.streamsMutex.Unlock()
+}
+
+//getSettings the settings negotiated with the client, version 0 for clients without settings
+func (sess *Session) getSettings() proto.Settings {
+	sess.streamsMutex.Lock()
+	defer sess.streamsMutex.Unlock()
+	return sess.settings
+}
+
+//shapingPolicy nil if the client did not ask for padding
+func (sess *Session) shapingPolicy() *proto.ShapingPolicy {
+	if !sess.getSettings().Has(proto.FEATURE_PADDING) {
+		return nil
+	}
+	return serverShaping
+}
+
+func (sess *Session) shaperWrite(data []byte) error {
+	sess.write(data)
+	return nil
+}
+
+//newShaper the shaper of a new stream, writing frames unchanged if the client did not ask for padding
+func (sess *Session) newShaper() *proto.Shaper {
+	return proto.NewShaper(sess.shapingPolicy(), sess.shaperWrite)
+}
+
+//newDatagramShaper the shaper of a new udp stream
+func (sess *Session) newDatagramShaper() *proto.Shaper {
+	return proto.NewDatagramShaper(sess.shapingPolicy(), sess.shaperWrite)
+}
+
+//applySettings answer the settings of the client with the settings of the server,
+//streams still choose their features with the STREAM_NEW flags
+func (sess *Session) applySettings(body []byte) error {
+	settings := proto.Settings{}
+	if err := settings.Decode(body); err != nil {
+		return err
+	}
+	sess.streamsMutex.Lock()
+	sess.settings = serverSettings.Negotiate(settings)
+	sess.streamsMutex.Unlock()
+	sess.write(serverSettings.Encode())
+	return nil
+}
+
+//getStream for other goroutines than the agent
+func (sess *Session) getStream(StreamID uint16) (stream, bool) {
+	sess.streamsMutex.Lock()
+	defer sess.streamsMutex.Unlock()
+	remote, ok := sess.streams[StreamID]
+	return remote, ok
+}
+
+//streamList for other goroutines than the agent
+func (sess *Session) streamList() map[uint16]stream {
+	sess.streamsMutex.Lock()
+	defer sess.streamsMutex.Unlock()
+	streams := make(map[uint16]stream, len(sess.streams))
+	for id, remote := range sess.streams {
+		streams[id] = remote
+	}
+	return streams
+}
+
+//remoteStreamDel the remote closed the stream, the client is sent STREAM_DEL
+func (sess *Session) remoteStreamDel(StreamID uint16, remote stream) {
 	select {
-	case sess.remoteStreamDelCh <- StreamID:
+	case sess.remoteStreamDelCh <- streamDone{StreamID, remote}:
 	case <-sess.Die:
 		break
 	}
 }
 
+//remoteStreamDone both directions of a half closed stream ended, no STREAM_DEL is sent
+func (sess *Session) remoteStreamDone(StreamID uint16, remote stream) {
+	select {
+	case sess.remoteStreamDoneCh <- streamDone{StreamID, remote}:
+	case <-sess.Die:
+		break
+	}
+}
+
+func (sess *Session) writeStreamFin(StreamID uint16) {
+	head := proto.MessageHead{}
+	head.StreamType = proto.STREAM_FIN
+	head.ProtoType = proto.TCP_PROTO
+	head.StreamID = StreamID
+	head.BodyLength = 0
+	var data [proto.HeadLength]byte
+	head.Encode(data[:])
+	sess.write(data[:])
+}
+
+func (sess *Session) writeStreamDel(StreamID uint16) {
+	head := proto.MessageHead{}
+	head.StreamType = proto.STREAM_DEL
+	head.ProtoType = proto.TCP_PROTO
+	head.StreamID = StreamID
+	head.BodyLength = 0
+	var data [proto.HeadLength]byte
+	head.Encode(data[:])
+	sess.write(data[:])
+}
+
+//writeStreamReply tell a client that asked for it how opening the stream ended
+func (sess *Session) writeStreamReply(StreamID uint16, code proto.ReplyCode) {
+	head := proto.MessageHead{}
+	head.StreamType = proto.STREAM_REPLY
+	head.ProtoType = proto.TCP_PROTO
+	head.StreamID = StreamID
+	head.BodyLength = 1
+	var data [proto.HeadLength + 1]byte
+	head.Encode(data[:])
+	data[proto.HeadLength] = byte(code)
+	sess.write(data[:])
+}
+
+//writeWindowUpdate grant the client more data on a stream with flow control
+func (sess *Session) writeWindowUpdate(StreamID uint16, increment uint32) {
+	head := proto.MessageHead{}
+	head.StreamType = proto.STREAM_WINDOW_UPDATE
+	head.ProtoType = proto.TCP_PROTO
+	head.StreamID = StreamID
+	head.BodyLength = proto.WindowUpdateLength
+	var data [proto.HeadLength + proto.WindowUpdateLength]byte
+	head.Encode(data[:])
+	binary.BigEndian.PutUint32(data[proto.HeadLength:], increment)
+	sess.write(data[:])
+}
+
+func (sess *Session) writePong(body []byte) {
+	head := proto.MessageHead{}
+	head.StreamType = proto.STREAM_PONG
+	head.ProtoType = proto.TCP_PROTO
+	head.StreamID = 0
+	head.BodyLength = uint16(len(body))
+	data := make([]byte, proto.HeadLength+len(body))
+	head.Encode(data)
+	copy(data[proto.HeadLength:], body)
+	sess.write(data)
+}
+
 func (sess *Session) agent(in <-chan *proto.Message) {
 
 	defer func() {
@@ -59,50 +270,99 @@ func (sess *Session) agent(in <-chan *proto.Message) {
 			if !ok {
 				return
 			}
-			if msg.Head.ProtoType == proto.TCP_PROTO {
-				if msg.Head.StreamType == proto.STREAM_NEW {
-					_, ok := sess.streams[msg.Head.StreamID]
-					if ok {
-						return
-					}
-					address := &proto.SOCKS5Address{}
-					_, err := address.Decode(msg.Body[0:msg.Head.BodyLength])
+			if msg.Head.StreamType == proto.STREAM_NEW {
+				_, ok := sess.streams[msg.Head.StreamID]
+				if ok {
+					fmt.Printf("client %v stream %v opened twice, session closed\n", sess.cfg.uuid, msg.Head.StreamID)
+					return
+				}
+				body := msg.Body[0:msg.Head.BodyLength]
+				var address *proto.SOCKS5Address
+				if msg.Head.ProtoType == proto.TCP_PROTO {
+					address = &proto.SOCKS5Address{}
+					n, err := address.Decode(body)
 					if err != nil {
 						return
 					}
-					remote := newRemote(sess)
-					sess.streams[msg.Head.StreamID] = remote
-					go remote.agent(msg.Head.StreamID, address.String())
-
-				} else if msg.Head.StreamType == proto.STREAM_DEL {
-					remote, ok := sess.streams[msg.Head.StreamID]
-					if ok {
-						delete(sess.streams, msg.Head.StreamID)
-						remote.stop(false)
-					}
+					body = body[n:]
+				}
+				//the flags byte follows the address
+				var flags byte
+				if len(body) > 0 {
+					flags = body[0]
+				}
+				wantReply := flags&proto.STREAM_NEW_WANT_REPLY != 0
 
-				} else if msg.Head.StreamType == proto.STREAM_DATA {
-					remote, ok := sess.streams[msg.Head.StreamID]
-					if ok {
-						remote.send(msg.Body[0:msg.Head.BodyLength])
+				if sess.cfg.limit.exceeded() {
+					fmt.Printf("client %v stream %v refused, quota exceeded\n", sess.cfg.uuid, msg.Head.StreamID)
+					streamOpenFailures.With("quota").Inc()
+					if wantReply {
+						sess.writeStreamReply(msg.Head.StreamID, proto.REPLY_DENIED)
 					}
+					sess.writeStreamDel(msg.Head.StreamID)
+					continue
+				}
+				if msg.Head.ProtoType == proto.TCP_PROTO {
+					flowControl := flags&proto.STREAM_NEW_FLOW_CONTROL != 0
+					halfClose := flowControl && flags&proto.STREAM_NEW_HALF_CLOSE != 0
+					remote := newRemote(sess, address, flowControl, halfClose)
+					sess.setStream(msg.Head.StreamID, remote)
+					go remote.agent(msg.Head.StreamID, address, wantReply)
 				} else {
+					remote := newRemoteUDP(sess)
+					sess.setStream(msg.Head.StreamID, remote)
+					go remote.agent(msg.Head.StreamID, wantReply)
+				}
+
+			} else if msg.Head.StreamType == proto.STREAM_PADDING {
+
+			} else if proto.IsSettings(&msg.Head) {
+				if sess.applySettings(msg.Body[0:msg.Head.BodyLength]) != nil {
 					return
 				}
+
+			} else if msg.Head.StreamType == proto.STREAM_DEL {
+				remote, ok := sess.streams[msg.Head.StreamID]
+				if ok {
+					sess.delStream(msg.Head.StreamID)
+					remote.stop(false)
+				}
+
+			} else if msg.Head.StreamType == proto.STREAM_DATA {
+				remote, ok := sess.streams[msg.Head.StreamID]
+				if ok {
+					remote.send(msg.Body[0:msg.Head.BodyLength])
+				}
+
+			} else if msg.Head.StreamType == proto.STREAM_FIN {
+				remote, ok := sess.streams[msg.Head.StreamID]
+				if ok {
+					remote.finish()
+				}
+
+			} else if msg.Head.StreamType == proto.STREAM_PING {
+				sess.writePong(msg.Body[0:msg.Head.BodyLength])
+
+			} else if msg.Head.StreamType == proto.STREAM_WINDOW_UPDATE {
+				remote, ok := sess.streams[msg.Head.StreamID]
+				if ok && msg.Head.BodyLength >= proto.WindowUpdateLength {
+					remote.windowUpdate(binary.BigEndian.Uint32(msg.Body))
+				}
 			} else {
 				return
 			}
 
-		case StreamID := <-sess.remoteStreamDelCh:
-			delete(sess.streams, StreamID)
-			head := proto.MessageHead{}
-			head.StreamType = proto.STREAM_DEL
-			head.ProtoType = proto.TCP_PROTO
-			head.StreamID = StreamID
-			head.BodyLength = 0
-			var data [proto.HeadLength]byte
-			head.Encode(data[:])
-			sess.write(data[:])
+		case done := <-sess.remoteStreamDelCh:
+			//a stream the client deleted already may have its id reused
+			if remote, ok := sess.streams[done.StreamID]; ok && remote == done.remote {
+				sess.delStream(done.StreamID)
+				sess.writeStreamDel(done.StreamID)
+			}
+
+		case done := <-sess.remoteStreamDoneCh:
+			if remote, ok := sess.streams[done.StreamID]; ok && remote == done.remote {
+				sess.delStream(done.StreamID)
+			}
 
 		case <-sess.clientWriteErrCh:
 			return
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const usageSaveInterval = time.Second * 10
+
+//clientUsage the bytes a client transferred in a quota period, period is
+//empty for the total quota or the month like 2006-01
+type clientUsage struct {
+	Period string
+	Bytes  uint64
+}
+
+//usageStore the traffic of all clients, persisted to a json file
+type usageStore struct {
+	path    string
+	mutex   sync.Mutex
+	clients map[uuid.UUID]*clientUsage
+	dirty   bool
+}
+
+func loadUsageStore(path string) (*usageStore, error) {
+	s := &usageStore{path: path, clients: make(map[uuid.UUID]*clientUsage)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.clients); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s *usageStore) add(id uuid.UUID, period string, n int) {
+	s.mutex.Lock()
+	usage, ok := s.clients[id]
+	if !ok {
+		usage = &clientUsage{}
+		s.clients[id] = usage
+	}
+	if usage.Period != period {
+		usage.Period = period
+		usage.Bytes = 0
+	}
+	usage.Bytes += uint64(n)
+	s.dirty = true
+	s.mutex.Unlock()
+}
+
+func (s *usageStore) used(id uuid.UUID, period string) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	usage, ok := s.clients[id]
+	if !ok || usage.Period != period {
+		return 0
+	}
+	return usage.Bytes
+}
+
+//save write the file if anything changed, through a temp file so a crash never leaves it half written
+func (s *usageStore) save() error {
+	s.mutex.Lock()
+	if !s.dirty {
+		s.mutex.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(s.clients, "", "\t")
+	s.dirty = false
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		s.mutex.Lock()
+		s.dirty = true
+		s.mutex.Unlock()
+	}
+	return err
+}
+
+func (s *usageStore) saveOnTimer() {
+	for {
+		select {
+		case <-time.After(usageSaveInterval):
+			if err := s.save(); err != nil {
+				fmt.Println("save usage error", err)
+			}
+		}
+	}
+}
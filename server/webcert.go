@@ -18,8 +18,10 @@ type webCert struct {
 func (p *webCert) updateWebCert() (version uint16, err error) {
 	cert, certNotAfter, version, err := getTLSCert(p.webAddr)
 	if err != nil {
+		webCertRefreshes.With("failure").Inc()
 		return version, err
 	}
+	webCertRefreshes.With("success").Inc()
 
 	p.mutex.Lock()
 	update := false